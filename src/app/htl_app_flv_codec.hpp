@@ -0,0 +1,53 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+#ifndef _htl_app_flv_codec_hpp
+#define _htl_app_flv_codec_hpp
+
+/*
+#include <htl_app_flv_codec.hpp>
+*/
+
+// the size of FLV header, tag header and previous tag size.
+#define FLV_HEADER_SIZE 9
+#define FLV_TAG_HEADER_SIZE 11
+#define FLV_PREVIOUS_TAG_SIZE 4
+
+// the frame type in FLV video tag.
+#define FlvKeyFrame 1
+#define FlvDisposableFrame 3
+// the codec id of h.264 in FLV video tag.
+#define FlvCodecAVC 7
+// the avc packet type in FLV video tag.
+#define AvcSequenceHeader 0
+#define AvcNALU 1
+
+// the nal unit type of h.264.
+#define NaluTypeNonIDR 1
+#define NaluTypeIDR 5
+#define NaluTypeSPS 7
+#define NaluTypePPS 8
+// the nal unit type 24-31 are unspecified, 0 is unspecified too.
+#define NaluTypeMax 23
+
+#endif
@@ -44,15 +44,19 @@ using namespace std;
 
 StHlsTask::StHlsTask(){
     target_duration = DEFAULT_TS_DURATION;
+    variant_index = 0;
+    last_segment_time = 0;
+    stale = false;
 }
 
 StHlsTask::~StHlsTask(){
 }
 
-int StHlsTask::Initialize(std::string http_url, bool vod, double startup, double delay, double error, int count){
+int StHlsTask::Initialize(std::string http_url, bool vod, double startup, double delay, double error, int count, int variant){
     int ret = ERROR_SUCCESS;
     
     is_vod = vod;
+    variant_index = variant;
     
     if((ret = InitializeBase(http_url, startup, delay, error, count)) != ERROR_SUCCESS){
         return ret;
@@ -68,19 +72,26 @@ Uri* StHlsTask::GetUri(){
 int StHlsTask::ProcessTask(){
     int ret = ERROR_SUCCESS;
     
-    Trace("start to process HLS task #%d, schema=%s, host=%s, port=%d, path=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
+    Event("start", "start to process HLS task #%d, schema=%s, host=%s, port=%d, path=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
         GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetPath(), startup_seconds, delay_seconds, error_seconds, count);
     
     // if count is zero, infinity loop.
-    for(int i = 0; count == 0 || i < count; i++){
+    for(int i = 0; ShouldRun(i); i++){
         statistic->OnTaskStart(GetId(), url.GetUrl());
         
         StHttpClient client;
         if((ret = ProcessM3u8(client)) != ERROR_SUCCESS){
-            statistic->OnTaskError(GetId(), 0);
+            statistic->OnTaskError(GetId(), 0, ret);
             
             Error("http client process m3u8 failed. ret=%d", ret);
-            st_usleep((st_utime_t)(error_seconds * 1000 * 1000));
+            
+            // the m3u8 request is wrong, for example, 403, never retry.
+            // but the 404 is ok, for the clients maybe start before the stream is published.
+            if(ret == ERROR_HTTP_STATUS_FATAL && client.GetResponseHeader()->status_code != 404){
+                return ret;
+            }
+            
+            st_usleep((st_utime_t)BuildErrorMTime() * 1000);
             continue;
         }
         
@@ -100,14 +111,19 @@ int StHlsTask::ProcessM3u8(StHttpClient& client){
     }
     Trace("[HLS] get m3u8 %s get success, length=%"PRId64, url.GetUrl(), (int64_t)m3u8.length());
     
-    string variant;
+    vector<string> variants;
     vector<M3u8TS> ts_objects;
-    if((ret = HlsM3u8Parser::ParseM3u8Data(&url, m3u8, ts_objects, target_duration, variant)) != ERROR_SUCCESS){
+    if((ret = HlsM3u8Parser::ParseM3u8Data(&url, m3u8, ts_objects, target_duration, variants)) != ERROR_SUCCESS){
         Error("http client parse m3u8 content failed. ret=%d", ret);
         return ret;
     }
     
-    if (!variant.empty()) {
+    // pick the variant by index, the last one if out of range.
+    if (!variants.empty()) {
+        int index = std::min(variant_index, (int)variants.size() - 1);
+        string variant = variants.at(index);
+        Trace("[HLS] pick variant #%d of %d, url=%s", index, (int)variants.size(), variant.c_str());
+        
         if ((ret = url.Initialize(variant)) != ERROR_SUCCESS) {
             Error("parse variant=%s failed, ret=%d", variant.c_str(), ret);
             return ret;
@@ -117,6 +133,11 @@ int StHlsTask::ProcessM3u8(StHttpClient& client){
     
     if((ret = ProcessTS(client, ts_objects)) != ERROR_SUCCESS){
         Error("http client download m3u8 ts file failed. ret=%d", ret);
+        
+        // the ts 4xx is not fatal, the segment maybe expired for live stream.
+        if(ret == ERROR_HTTP_STATUS_FATAL){
+            ret = ERROR_HTTP_STATUS_RETRY;
+        }
         return ret;
     }
 
@@ -142,9 +163,26 @@ int StHlsTask::ProcessTS(StHttpClient& client, vector<M3u8TS>& ts_objects){
             ite++;
         }
         
-        // no ts now, wait for a segment
+        // the playlist got new segment when its last segment changed, whatever
+        // the segments downloaded by this client, which maybe slow or lagging.
+        int64_t now = StUtility::GetCurrentTime();
+        string last_ts = ts_objects.empty()? "" : ts_objects.back().ts_url;
+        if(last_ts != last_playlist_ts || last_segment_time <= 0){
+            last_playlist_ts = last_ts;
+            last_segment_time = now;
+            stale = false;
+        }
+        
+        // the playlist is stale when no new segment for 2 target duration.
+        int64_t stale_ms = 2 * 1000 * ((target_duration > 0)? target_duration:DEFAULT_TS_DURATION);
+        if(!stale && now - last_segment_time > stale_ms){
+            stale = true;
+            statistic->OnStale(GetId());
+            Event("stale", "[HLS] %s no new segment for %"PRId64"ms", url.GetUrl(), now - last_segment_time);
+        }
+        
         if(ite == ts_objects.end()){
-            int sleep_ms = StUtility::BuildRandomMTime((target_duration > 0)? target_duration:DEFAULT_TS_DURATION);
+            int sleep_ms = StUtility::BuildRandomMTime((target_duration > 0)? target_duration:DEFAULT_TS_DURATION, &delay_seed);
             Trace("[TS] no fresh ts, wait for a while. sleep %dms", sleep_ms);
             st_usleep(sleep_ms * 1000);
             
@@ -183,16 +221,21 @@ int StHlsTask::DownloadTS(StHttpClient& client, M3u8TS& ts){
     Info("[TS] url=%s, duration=%.2f, delay=%.2f", url.GetUrl(), ts.duration, delay_seconds);
     statistic->OnSubTaskStart(GetId(), ts.ts_url);
     
+    int64_t starttime = StUtility::GetCurrentTime();
     if((ret = client.DownloadString(&url, NULL)) != ERROR_SUCCESS){
-        statistic->OnSubTaskError(GetId(), (int)ts.duration);
+        statistic->OnSubTaskError(GetId(), (int)ts.duration, ret);
             
         Error("http client download ts file %s failed. ret=%d", url.GetUrl(), ret);
         return ret;
     }
     
-    int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:ts.duration);
-    Trace("[TS] url=%s download, duration=%.2f, delay=%.2f, size=%"PRId64", sleep %dms", 
-        url.GetUrl(), ts.duration, delay_seconds, client.GetResponseHeader()->content_length, sleep_ms);
+    int64_t latency = StUtility::GetCurrentTime() - starttime;
+    int64_t size = (int64_t)client.GetResponseHeader()->content_length;
+    statistic->OnSegment(GetId(), latency, size);
+    
+    int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:ts.duration, &delay_seed);
+    Trace("[TS] url=%s download, duration=%.2f, delay=%.2f, size=%"PRId64", latency=%"PRId64"ms, sleep %dms", 
+        url.GetUrl(), ts.duration, delay_seconds, size, latency, sleep_ms);
     st_usleep(sleep_ms * 1000);
     
     statistic->OnSubTaskEnd(GetId(), (int)ts.duration);
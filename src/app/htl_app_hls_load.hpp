@@ -40,11 +40,18 @@ private:
     M3u8TS last_downloaded_ts;
     int target_duration;
     bool is_vod;
+    // the index of variant to play for master playlist.
+    int variant_index;
+    // the last segment of playlist, and the time in ms when the playlist got it,
+    // to detect the stale playlist of live.
+    std::string last_playlist_ts;
+    int64_t last_segment_time;
+    bool stale;
 public:
     StHlsTask();
     virtual ~StHlsTask();
 public:
-    virtual int Initialize(std::string http_url, bool vod, double startup, double delay, double error, int count);
+    virtual int Initialize(std::string http_url, bool vod, double startup, double delay, double error, int count, int variant);
 protected:
     virtual Uri* GetUri();
     virtual int ProcessTask();
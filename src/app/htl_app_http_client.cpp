@@ -105,22 +105,58 @@ void StHttpClient::OnHeaderCompleted(http_parser* parser){
 int StHttpClient::ParseResponse(HttpUrl* url, string* response){
     int ret = ERROR_SUCCESS;
 
+    // always keep the body, for the error response carry the message of server.
+    string body;
+    string* content = (response != NULL)? response : &body;
+
     int body_received = 0;
-    if((ret = ParseResponseHeader(response, body_received)) != ERROR_SUCCESS){
+    if((ret = ParseResponseHeader(content, body_received)) != ERROR_SUCCESS){
         Error("parse response header failed. ret=%d", ret);
         return ret;
     }
+    
+    // ignore the body of success response, use shared fast memory.
+    if(response == NULL && http_header.status_code < 400){
+        content = NULL;
+    }
 
-    if((ret = ParseResponseBody(url, response, body_received)) != ERROR_SUCCESS){
+    if((ret = ParseResponseBody(url, content, body_received)) != ERROR_SUCCESS){
         Error("parse response body failed. ret=%d", ret);
         return ret;
     }
+    
+    if((ret = CheckStatus(url, content)) != ERROR_SUCCESS){
+        return ret;
+    }
 
     Info("url %s download, body size=%"PRId64, url->GetUrl(), http_header.content_length);
     
     return ret;
 }
 
+int StHttpClient::CheckStatus(HttpUrl* url, string* body){
+    int ret = ERROR_SUCCESS;
+    
+    int status = http_header.status_code;
+    if(status < 400){
+        return ret;
+    }
+    
+    // the server is busy, for example, 503 when SRS is overloaded, retry it.
+    if(status >= 500 || status == 429){
+        ret = ERROR_HTTP_STATUS_RETRY;
+    }
+    else{
+        ret = ERROR_HTTP_STATUS_FATAL;
+    }
+    
+    // only log the head of message, the error page maybe very large.
+    string message = (body != NULL)? body->substr(0, HTTP_ERROR_MESSAGE_MAX) : "";
+    Error("url %s response status=%d, message=%s, ret=%d", url->GetUrl(), status, message.c_str(), ret);
+    
+    return ret;
+}
+
 int StHttpClient::ParseResponseBody(HttpUrl* url, string* response, int body_received){
     int ret = ERROR_SUCCESS;
     
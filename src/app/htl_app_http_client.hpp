@@ -47,6 +47,7 @@ public:
     /**
     * download the content specified by url using HTTP GET method.
     * @response the string pointer which store the content. ignore content if set to NULL.
+    * @return ERROR_HTTP_STATUS_RETRY for status 5xx or 429, ERROR_HTTP_STATUS_FATAL for other 4xx.
     */
     virtual int DownloadString(HttpUrl* url, std::string* response);
 public:
@@ -63,6 +64,7 @@ private:
     virtual int ParseResponseBody(HttpUrl* url, string* response, int body_received);
     virtual int ParseResponseBodyData(HttpUrl* url, string* response, size_t body_left, const void* buf, size_t size);
     virtual int ParseResponseHeader(string* response, int& body_received);
+    virtual int CheckStatus(HttpUrl* url, string* body);
     virtual int Connect(HttpUrl* url);
     virtual int CheckUrl(HttpUrl* url);
 };
@@ -0,0 +1,393 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+#include <htl_stdinc.hpp>
+
+#include <inttypes.h>
+#include <string.h>
+
+#include <string>
+#include <sstream>
+using namespace std;
+
+#include <htl_core_error.hpp>
+#include <htl_core_log.hpp>
+#include <htl_app_rtmp_protocol.hpp>
+#include <htl_app_flv_codec.hpp>
+
+#include <htl_app_http_flv_load.hpp>
+
+StHttpFlvClient::StHttpFlvClient(){
+    socket = NULL;
+    status_code = 0;
+    message_completed = false;
+    flv_header_parsed = false;
+    connect_time = 0;
+    nb_audio = nb_video = nb_bytes = 0;
+}
+
+StHttpFlvClient::~StHttpFlvClient(){
+    delete socket;
+    socket = NULL;
+}
+
+void StHttpFlvClient::SetFreeze(int freeze_ms){
+    stat.SetFreeze(freeze_ms);
+}
+
+int StHttpFlvClient::Dump(HttpUrl* url){
+    int ret = ERROR_SUCCESS;
+    
+    connect_time = StUtility::GetCurrentTime();
+    stat.OnConnect(connect_time);
+    
+    status_code = 0;
+    body.clear();
+    message_completed = false;
+    flv_header_parsed = false;
+    nb_audio = nb_video = nb_bytes = 0;
+    
+    if((ret = Connect(url)) != ERROR_SUCCESS){
+        Error("http-flv client connect url failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if((ret = Request(url)) != ERROR_SUCCESS){
+        Error("http-flv client request url failed. ret=%d", ret);
+        return ret;
+    }
+    
+    ret = DumpFlv();
+    stat.OnClose();
+    
+    // the play is interrupted by quit, it's done rather than failed.
+    if(ret != ERROR_SUCCESS && StFarm::IsQuit()){
+        ret = ERROR_SUCCESS;
+    }
+    
+    Event("startup", "[FLV] %s closed, audio=%"PRId64", video=%"PRId64", bytes=%"PRId64", "
+        "first_packet=%"PRId64"ms, first_audio=%"PRId64"ms, first_video=%"PRId64"ms", url->GetUrl(), 
+        nb_audio, nb_video, nb_bytes, stat.first_packet_ms, stat.first_audio_ms, stat.first_video_ms);
+    
+    // close the connection, the task will sleep then reconnect.
+    socket->Close();
+    
+    if(ret != ERROR_SUCCESS){
+        Error("http-flv client dump flv failed. ret=%d", ret);
+        return ret;
+    }
+    
+    return ret;
+}
+
+int StHttpFlvClient::GetStatusCode(){
+    return status_code;
+}
+
+int StHttpFlvClient::Connect(HttpUrl* url){
+    int ret = ERROR_SUCCESS;
+    
+    delete socket;
+    socket = new StSocket();
+    
+    string ip;
+    if((ret = StUtility::DnsResolve(url->GetHost(), ip)) != ERROR_SUCCESS){
+        Error("dns resolve failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if((ret = socket->Connect(ip.c_str(), url->GetPort())) != ERROR_SUCCESS){
+        Error("connect to server failed. ret=%d", ret);
+        return ret;
+    }
+    
+    Info("socket connected on url %s", url->GetUrl());
+    
+    return ret;
+}
+
+int StHttpFlvClient::Request(HttpUrl* url){
+    int ret = ERROR_SUCCESS;
+    
+    // GET %s HTTP/1.1\r\nHost: %s\r\n\r\n
+    stringstream ss;
+    ss << "GET " << url->GetPath() << " "
+        << "HTTP/1.1\r\n"
+        << "Host: " << url->GetHost() << "\r\n"
+        << "User-Agent: " << ProductHttpFlvName << "\r\n"
+        << "\r\n";
+    
+    ssize_t nwrite;
+    if((ret = socket->Write(ss.str().c_str(), ss.str().length(), &nwrite)) != ERROR_SUCCESS){
+        Error("write to server failed. ret=%d", ret);
+        return ret;
+    }
+    
+    return ret;
+}
+
+int StHttpFlvClient::DumpFlv(){
+    int ret = ERROR_SUCCESS;
+    
+    http_parser_settings settings;
+    memset(&settings, 0, sizeof(settings));
+    settings.on_headers_complete = on_headers_complete;
+    settings.on_body = on_body;
+    settings.on_message_complete = on_message_complete;
+    
+    http_parser_init(&parser, HTTP_RESPONSE);
+    // callback object ptr.
+    parser.data = (void*)this;
+    
+    // the body is copied to string when parse, so use shared fast memory.
+    static char buf[HTTP_BODY_BUFFER];
+    
+    // the live stream should never stall, raise it when no data for a while.
+    socket->SetRecvTimeout(HTTP_FLV_STALL_MS * 1000);
+    
+    bool played = false;
+    for(;;){
+        ssize_t nread;
+        if((ret = socket->Read((const void*)buf, (size_t)sizeof(buf), &nread)) != ERROR_SUCCESS){
+            if(ret == ERROR_SOCKET_TIMEOUT){
+                Error("http-flv stream stalled for %dms. ret=%d", HTTP_FLV_STALL_MS, ret);
+                return ret;
+            }
+            
+            // notify the parser the EOF, for the body without length ends by close.
+            http_parser_execute(&parser, &settings, NULL, 0);
+            if(message_completed){
+                ret = ERROR_HTTP_FLV_EOF;
+                Error("http-flv stream closed by server, left=%d. ret=%d", (int)body.length(), ret);
+                return ret;
+            }
+            
+            Error("read flv from server failed. ret=%d", ret);
+            return ret;
+        }
+        
+        ssize_t nparsed = http_parser_execute(&parser, &settings, buf, nread);
+        if(nparsed != nread){
+            ret = ERROR_HP_PARSE_RESPONSE;
+            Error("parse response error, parsed(%d)!=read(%d), ret=%d", (int)nparsed, (int)nread, ret);
+            return ret;
+        }
+        
+        // wait for the header.
+        if(status_code == 0){
+            continue;
+        }
+        
+        if(status_code != 200){
+            ret = (status_code >= 500 || status_code == 429)? ERROR_HTTP_STATUS_RETRY : ERROR_HTTP_STATUS_FATAL;
+            Error("http-flv response status=%d, ret=%d", status_code, ret);
+            return ret;
+        }
+        
+        if(!played){
+            played = true;
+            int64_t play_ms = StUtility::GetCurrentTime() - connect_time;
+            statistic->OnSetup(context->GetId(), play_ms);
+            Event("play", "http-flv client play stream success in %"PRId64"ms", play_ms);
+        }
+        
+        if((ret = ParseTags()) != ERROR_SUCCESS){
+            Error("parse flv tags failed. ret=%d", ret);
+            return ret;
+        }
+        
+        // the live stream never end, the server maybe unpublished.
+        if(message_completed){
+            ret = ERROR_HTTP_FLV_EOF;
+            Error("http-flv stream end by server, left=%d. ret=%d", (int)body.length(), ret);
+            return ret;
+        }
+    }
+    
+    return ret;
+}
+
+int StHttpFlvClient::ParseTags(){
+    int ret = ERROR_SUCCESS;
+    
+    u_int8_t* data = (u_int8_t*)body.data();
+    size_t size = body.length();
+    size_t pos = 0;
+    
+    // FLV header, then the previous tag size of zero.
+    if(!flv_header_parsed){
+        if(size < FLV_HEADER_SIZE + FLV_PREVIOUS_TAG_SIZE){
+            return ret;
+        }
+        
+        if(data[0] != 'F' || data[1] != 'L' || data[2] != 'V'){
+            ret = ERROR_HTTP_FLV_HEADER;
+            Error("flv header must start with FLV. ret=%d", ret);
+            return ret;
+        }
+        
+        // the DataOffset, the size of header.
+        u_int32_t offset = (data[5] << 24) | (data[6] << 16) | (data[7] << 8) | data[8];
+        if(offset < FLV_HEADER_SIZE || offset > HTTP_HEADER_BUFFER){
+            ret = ERROR_HTTP_FLV_HEADER;
+            Error("invalid flv header size=%u. ret=%d", offset, ret);
+            return ret;
+        }
+        
+        if(size < offset + FLV_PREVIOUS_TAG_SIZE){
+            return ret;
+        }
+        
+        pos = offset + FLV_PREVIOUS_TAG_SIZE;
+        flv_header_parsed = true;
+    }
+    
+    while(pos + FLV_TAG_HEADER_SIZE <= size){
+        u_int8_t* th = data + pos;
+        
+        char type = th[0] & 0x1F;
+        int32_t tag_size = (th[1] << 16) | (th[2] << 8) | th[3];
+        u_int32_t timestamp = (th[7] << 24) | (th[4] << 16) | (th[5] << 8) | th[6];
+        
+        if(type != SRS_RTMP_TYPE_AUDIO && type != SRS_RTMP_TYPE_VIDEO && type != SRS_RTMP_TYPE_SCRIPT){
+            ret = ERROR_HTTP_FLV_TAG;
+            Error("invalid flv tag type=%d. ret=%d", type, ret);
+            return ret;
+        }
+        
+        // reject the corrupt tag, never buffer it.
+        if(tag_size > HTTP_FLV_MAX_TAG){
+            ret = ERROR_HTTP_FLV_TAG;
+            Error("flv tag too large, size=%d, max=%d. ret=%d", tag_size, HTTP_FLV_MAX_TAG, ret);
+            return ret;
+        }
+        
+        // wait for the whole tag.
+        if(pos + FLV_TAG_HEADER_SIZE + tag_size + FLV_PREVIOUS_TAG_SIZE > size){
+            break;
+        }
+        
+        u_int8_t* pts = th + FLV_TAG_HEADER_SIZE + tag_size;
+        int32_t previous_tag_size = (pts[0] << 24) | (pts[1] << 16) | (pts[2] << 8) | pts[3];
+        if(previous_tag_size != tag_size + FLV_TAG_HEADER_SIZE){
+            ret = ERROR_HTTP_FLV_TAG;
+            Error("flv previous tag size mismatch, %d!=%d. ret=%d", previous_tag_size, tag_size + FLV_TAG_HEADER_SIZE, ret);
+            return ret;
+        }
+        
+        Info("get tag type=%d, size=%d, time=%u", type, tag_size, timestamp);
+        
+        nb_bytes += tag_size;
+        if(type == SRS_RTMP_TYPE_AUDIO){
+            nb_audio++;
+        }
+        if(type == SRS_RTMP_TYPE_VIDEO){
+            nb_video++;
+            stat.OnVideo(timestamp, (char*)th + FLV_TAG_HEADER_SIZE, tag_size);
+        }
+        stat.OnPacket(type);
+        
+        pos += FLV_TAG_HEADER_SIZE + tag_size + FLV_PREVIOUS_TAG_SIZE;
+    }
+    
+    body.erase(0, pos);
+    
+    return ret;
+}
+
+int StHttpFlvClient::on_headers_complete(http_parser* parser){
+    StHttpFlvClient* obj = (StHttpFlvClient*)parser->data;
+    obj->status_code = parser->status_code;
+    return 0;
+}
+
+int StHttpFlvClient::on_body(http_parser* parser, const char* at, size_t length){
+    StHttpFlvClient* obj = (StHttpFlvClient*)parser->data;
+    obj->body.append(at, length);
+    return 0;
+}
+
+int StHttpFlvClient::on_message_complete(http_parser* parser){
+    StHttpFlvClient* obj = (StHttpFlvClient*)parser->data;
+    obj->message_completed = true;
+    return 0;
+}
+
+StHttpFlvTask::StHttpFlvTask(){
+    freeze_ms = 0;
+}
+
+StHttpFlvTask::~StHttpFlvTask(){
+}
+
+int StHttpFlvTask::Initialize(string http_url, double startup, double delay, double error, int count, int freeze_ms){
+    int ret = ERROR_SUCCESS;
+    
+    this->freeze_ms = freeze_ms;
+    
+    if((ret = InitializeBase(http_url, startup, delay, error, count)) != ERROR_SUCCESS){
+        return ret;
+    }
+    
+    return ret;
+}
+
+Uri* StHttpFlvTask::GetUri(){
+    return &url;
+}
+
+int StHttpFlvTask::ProcessTask(){
+    int ret = ERROR_SUCCESS;
+    
+    Event("start", "start to process HTTP-FLV task #%d, schema=%s, host=%s, port=%d, path=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
+        GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetPath(), startup_seconds, delay_seconds, error_seconds, count);
+    
+    StHttpFlvClient client;
+    client.SetFreeze(freeze_ms);
+    
+    // if count is zero, infinity loop.
+    for(int i = 0; ShouldRun(i); i++){
+        statistic->OnTaskStart(GetId(), url.GetUrl());
+        
+        if((ret = client.Dump(&url)) != ERROR_SUCCESS){
+            statistic->OnTaskError(GetId(), 0, ret);
+            
+            Error("http-flv client play url failed. ret=%d", ret);
+            
+            // the request is wrong, for example, 403, never retry.
+            // but the 404 is ok, for the clients maybe start before the stream is published.
+            if(ret == ERROR_HTTP_STATUS_FATAL && client.GetStatusCode() != 404){
+                return ret;
+            }
+            
+            st_usleep((st_utime_t)BuildErrorMTime() * 1000);
+            continue;
+        }
+        
+        // the live stream never end, so the play only success when quit.
+        statistic->OnTaskEnd(GetId(), 0);
+        Trace("[FLV] %s play done", url.GetUrl());
+    }
+    
+    return ret;
+}
@@ -0,0 +1,106 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+#ifndef _htl_app_http_flv_load_hpp
+#define _htl_app_http_flv_load_hpp
+
+/*
+#include <htl_app_http_flv_load.hpp>
+*/
+#include <string>
+
+#include <htl_core_uri.hpp>
+#include <htl_os_st.hpp>
+
+#include <htl_app_rtmp_play.hpp>
+#include <htl_app_task_base.hpp>
+
+/**
+* the HTTP-FLV player, GET the flv stream and parse the tags,
+* the body is decoded by http parser, so the chunked encoding is ok.
+*/
+class StHttpFlvClient
+{
+private:
+    StSocket* socket;
+    http_parser parser;
+    // the status of response, 0 if header not completed.
+    int status_code;
+    // the body decoded by http parser, not parsed as flv tags yet.
+    std::string body;
+    // whether the response end, the live stream should never end.
+    bool message_completed;
+    bool flv_header_parsed;
+    // the time in ms when start to connect, to stat the startup.
+    int64_t connect_time;
+    StPlayStat stat;
+    // the tags and bytes received of current connection.
+    int64_t nb_audio, nb_video, nb_bytes;
+public:
+    StHttpFlvClient();
+    virtual ~StHttpFlvClient();
+public:
+    /**
+    * detect the video freeze, when got no new video timestamp for the ms.
+    */
+    virtual void SetFreeze(int freeze_ms);
+    /**
+    * play the url until error or quit.
+    * @return ERROR_HTTP_FLV_EOF when server end the stream, ERROR_SOCKET_TIMEOUT
+    *       when the stream stalled, ERROR_SUCCESS when interrupted by quit.
+    */
+    virtual int Dump(HttpUrl* url);
+    /**
+    * the status of last response, 0 if header not completed.
+    */
+    virtual int GetStatusCode();
+private:
+    virtual int Connect(HttpUrl* url);
+    virtual int Request(HttpUrl* url);
+    virtual int DumpFlv();
+    // parse the tags in body, the incomplete tag is left in body.
+    virtual int ParseTags();
+private:
+    static int on_headers_complete(http_parser* parser);
+    static int on_body(http_parser* parser, const char* at, size_t length);
+    static int on_message_complete(http_parser* parser);
+};
+
+// for HTTP-FLV play task.
+class StHttpFlvTask : public StBaseTask
+{
+private:
+    HttpUrl url;
+    // the ms without new video to detect the freeze, 0 to disable.
+    int freeze_ms;
+public:
+    StHttpFlvTask();
+    virtual ~StHttpFlvTask();
+public:
+    virtual int Initialize(std::string http_url, double startup, double delay, double error, int count, int freeze_ms);
+protected:
+    virtual Uri* GetUri();
+    virtual int ProcessTask();
+};
+
+#endif
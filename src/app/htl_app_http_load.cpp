@@ -59,24 +59,30 @@ Uri* StHttpTask::GetUri(){
 int StHttpTask::ProcessTask(){
     int ret = ERROR_SUCCESS;
     
-    Trace("start to process HTTP task #%d, schema=%s, host=%s, port=%d, path=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
+    Event("start", "start to process HTTP task #%d, schema=%s, host=%s, port=%d, path=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
         GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetPath(), startup_seconds, delay_seconds, error_seconds, count);
         
     StHttpClient client;
     
     // if count is zero, infinity loop.
-    for(int i = 0; count == 0 || i < count; i++){
+    for(int i = 0; ShouldRun(i); i++){
         statistic->OnTaskStart(GetId(), url.GetUrl());
         
         if((ret = client.DownloadString(&url, NULL)) != ERROR_SUCCESS){
-            statistic->OnTaskError(GetId(), 0);
+            statistic->OnTaskError(GetId(), 0, ret);
             
             Error("http client get url failed. ret=%d", ret);
-            st_usleep((st_utime_t)(error_seconds * 1000 * 1000));
+            
+            // the request is wrong, for example, 404, never retry.
+            if(ret == ERROR_HTTP_STATUS_FATAL){
+                return ret;
+            }
+            
+            st_usleep((st_utime_t)BuildErrorMTime() * 1000);
             continue;
         }
         
-        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0);
+        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0, &delay_seed);
         Info("[HTTP] %s download, size=%"PRId64", sleep %dms", url.GetUrl(), client.GetResponseHeader()->content_length, sleep_ms);
         st_usleep(sleep_ms * 1000);
         
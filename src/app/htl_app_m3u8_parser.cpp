@@ -128,7 +128,7 @@ HlsM3u8Parser::HlsM3u8Parser(){
 HlsM3u8Parser::~HlsM3u8Parser(){
 }
 
-int HlsM3u8Parser::ParseM3u8Data(HttpUrl* url, string m3u8, vector<M3u8TS>& ts_objects, int& target_duration, string& variant){
+int HlsM3u8Parser::ParseM3u8Data(HttpUrl* url, string m3u8, vector<M3u8TS>& ts_objects, int& target_duration, vector<string>& variants){
     int ret = ERROR_SUCCESS;
     
     String data(m3u8);
@@ -145,6 +145,7 @@ int HlsM3u8Parser::ParseM3u8Data(HttpUrl* url, string m3u8, vector<M3u8TS>& ts_o
     String value;
     
     M3u8TS ts_object;
+    bool is_variant = false;
     while(data.length() > 0){
         String line;
         data.remove(line.set_str(data.strip().getline()).strip().length()).strip();
@@ -161,8 +162,8 @@ int HlsM3u8Parser::ParseM3u8Data(HttpUrl* url, string m3u8, vector<M3u8TS>& ts_o
         // #EXT-X-STREAM-INF:BANDWIDTH=3000000
         // http://192.168.13.108:28080/gh.b0.upaiyun.com/app01/stream01.m3u8
         if (line.startswith("#EXT-X-STREAM-INF:", &value)) {
-            variant = data.strip().getline();
-            return ret;
+            is_variant = true;
+            continue;
         }
         
         // http://tools.ietf.org/html/draft-pantos-http-live-streaming-08#section-3.3.2
@@ -180,6 +181,12 @@ int HlsM3u8Parser::ParseM3u8Data(HttpUrl* url, string m3u8, vector<M3u8TS>& ts_o
             continue;
         }
         
+        if(!line.startswith("#") && is_variant){
+            variants.push_back(url->Resolve(line.c_str()));
+            is_variant = false;
+            continue;
+        }
+        
         if(!line.startswith("#")){
             ts_object.ts_url = url->Resolve(line.c_str());
             ts_objects.push_back(ts_object);
@@ -48,7 +48,11 @@ public:
     HlsM3u8Parser();
     virtual ~HlsM3u8Parser();
 public:
-    static int ParseM3u8Data(HttpUrl* url, std::string m3u8, std::vector<M3u8TS>& ts_objects, int& target_duration, std::string& variant);
+    /**
+    * parse the m3u8, get the ts of media playlist, or the variants of master playlist.
+    * @param variants the url of each variant, in the order of m3u8.
+    */
+    static int ParseM3u8Data(HttpUrl* url, std::string m3u8, std::vector<M3u8TS>& ts_objects, int& target_duration, std::vector<std::string>& variants);
 };
 
 #endif
@@ -38,14 +38,23 @@ using namespace std;
 #include <htl_app_rtmp_load.hpp>
 
 StRtmpTask::StRtmpTask(){
+    packets = 0;
+    freeze_ms = 0;
+    validate = false;
 }
 
 StRtmpTask::~StRtmpTask(){
 }
 
-int StRtmpTask::Initialize(string http_url, double startup, double delay, double error, int count){
+int StRtmpTask::Initialize(string http_url, double startup, double delay, double error, int count, 
+    int packets, string dump_video, int freeze_ms
+){
     int ret = ERROR_SUCCESS;
     
+    this->packets = packets;
+    this->dump_video = dump_video;
+    this->freeze_ms = freeze_ms;
+    
     if((ret = InitializeBase(http_url, startup, delay, error, count)) != ERROR_SUCCESS){
         return ret;
     }
@@ -53,6 +62,10 @@ int StRtmpTask::Initialize(string http_url, double startup, double delay, double
     return ret;
 }
 
+void StRtmpTask::SetValidate(bool validate){
+    this->validate = validate;
+}
+
 Uri* StRtmpTask::GetUri(){
     return &url;
 }
@@ -60,24 +73,35 @@ Uri* StRtmpTask::GetUri(){
 int StRtmpTask::ProcessTask(){
     int ret = ERROR_SUCCESS;
     
-    Trace("start to process RTMP play task #%d, schema=%s, host=%s, port=%d, tcUrl=%s, stream=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
-        GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetTcUrl(), url.GetStream(), startup_seconds, delay_seconds, error_seconds, count);
+    Event("start", "start to process RTMP play task #%d, schema=%s, host=%s, port=%d, tcUrl=%s, stream=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d, packets=%d", 
+        GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetTcUrl(), url.GetStream(), startup_seconds, delay_seconds, error_seconds, count, packets);
        
+    // the client is reused for each cycle of churn, which destroy the last connection when connect.
     StRtmpPlayClient client;
+    client.SetFreeze(freeze_ms);
+    
+    if(validate){
+        client.ValidateVideo();
+    }
+    
+    if(!dump_video.empty() && (ret = client.DumpVideo(dump_video)) != ERROR_SUCCESS){
+        Error("rtmp client dump video to %s failed. ret=%d", dump_video.c_str(), ret);
+        return ret;
+    }
     
     // if count is zero, infinity loop.
-    for(int i = 0; count == 0 || i < count; i++){
+    for(int i = 0; ShouldRun(i); i++){
         statistic->OnTaskStart(GetId(), url.GetUrl());
         
-        if((ret = client.Dump(&url)) != ERROR_SUCCESS){
-            statistic->OnTaskError(GetId(), 0);
+        if((ret = client.Dump(&url, packets)) != ERROR_SUCCESS){
+            statistic->OnTaskError(GetId(), 0, ret);
             
             Error("rtmp client dump url failed. ret=%d", ret);
-            st_usleep((st_utime_t)(error_seconds * 1000 * 1000));
+            st_usleep((st_utime_t)BuildErrorMTime() * 1000);
             continue;
         }
         
-        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0);
+        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0, &delay_seed);
         Trace("[RTMP] %s dump success, sleep %dms", url.GetUrl(), sleep_ms);
         st_usleep(sleep_ms * 1000);
         
@@ -110,24 +134,24 @@ Uri* StRtmpTaskFast::GetUri(){
 int StRtmpTaskFast::ProcessTask(){
     int ret = ERROR_SUCCESS;
     
-    Trace("start to process RTMP play fast task #%d, schema=%s, host=%s, port=%d, tcUrl=%s, stream=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
+    Event("start", "start to process RTMP play fast task #%d, schema=%s, host=%s, port=%d, tcUrl=%s, stream=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
         GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetTcUrl(), url.GetStream(), startup_seconds, delay_seconds, error_seconds, count);
        
     StRtmpPlayClientFast client;
     
     // if count is zero, infinity loop.
-    for(int i = 0; count == 0 || i < count; i++){
+    for(int i = 0; ShouldRun(i); i++){
         statistic->OnTaskStart(GetId(), url.GetUrl());
         
-        if((ret = client.Dump(&url)) != ERROR_SUCCESS){
-            statistic->OnTaskError(GetId(), 0);
+        if((ret = client.Dump(&url, 0)) != ERROR_SUCCESS){
+            statistic->OnTaskError(GetId(), 0, ret);
             
             Error("rtmp client dump url failed. ret=%d", ret);
-            st_usleep((st_utime_t)(error_seconds * 1000 * 1000));
+            st_usleep((st_utime_t)BuildErrorMTime() * 1000);
             continue;
         }
         
-        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0);
+        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0, &delay_seed);
         Trace("[RTMP] %s dump success, sleep %dms", url.GetUrl(), sleep_ms);
         st_usleep(sleep_ms * 1000);
         
@@ -138,15 +162,20 @@ int StRtmpTaskFast::ProcessTask(){
 }
 
 StRtmpPublishTask::StRtmpPublishTask(){
+    audio = video = true;
+    bitrate = 0;
+    switch_seconds = 0;
 }
 
 StRtmpPublishTask::~StRtmpPublishTask(){
 }
 
-int StRtmpPublishTask::Initialize(string input, string http_url, double startup, double delay, double error, int count){
+int StRtmpPublishTask::Initialize(string input, string http_url, double startup, double delay, double error, int count, bool audio, bool video){
     int ret = ERROR_SUCCESS;
     
     input_flv_file = input;
+    this->audio = audio;
+    this->video = video;
     
     if((ret = InitializeBase(http_url, startup, delay, error, count)) != ERROR_SUCCESS){
         return ret;
@@ -155,6 +184,15 @@ int StRtmpPublishTask::Initialize(string input, string http_url, double startup,
     return ret;
 }
 
+void StRtmpPublishTask::SetBitrate(int kbps){
+    bitrate = kbps;
+}
+
+void StRtmpPublishTask::SetSwitch(string input, double seconds){
+    switch_input = input;
+    switch_seconds = seconds;
+}
+
 Uri* StRtmpPublishTask::GetUri(){
     return &url;
 }
@@ -162,24 +200,26 @@ Uri* StRtmpPublishTask::GetUri(){
 int StRtmpPublishTask::ProcessTask(){
     int ret = ERROR_SUCCESS;
     
-    Trace("start to process RTMP publish task #%d, schema=%s, host=%s, port=%d, tcUrl=%s, stream=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d", 
-        GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetTcUrl(), url.GetStream(), startup_seconds, delay_seconds, error_seconds, count);
+    Event("start", "start to process RTMP publish task #%d, schema=%s, host=%s, port=%d, tcUrl=%s, stream=%s, startup=%.2f, delay=%.2f, error=%.2f, count=%d, audio=%d, video=%d", 
+        GetId(), url.GetSchema(), url.GetHost(), url.GetPort(), url.GetTcUrl(), url.GetStream(), startup_seconds, delay_seconds, error_seconds, count, audio, video);
        
     StRtmpPublishClient client;
+    client.SetBitrate(bitrate);
+    client.SetSwitch(switch_input, switch_seconds);
     
     // if count is zero, infinity loop.
-    for(int i = 0; count == 0 || i < count; i++){
+    for(int i = 0; ShouldRun(i); i++){
         statistic->OnTaskStart(GetId(), url.GetUrl());
         
-        if((ret = client.Publish(input_flv_file, &url)) != ERROR_SUCCESS){
-            statistic->OnTaskError(GetId(), 0);
+        if((ret = client.Publish(input_flv_file, &url, audio, video)) != ERROR_SUCCESS){
+            statistic->OnTaskError(GetId(), 0, ret);
             
             Error("rtmp client publish url failed. ret=%d", ret);
-            st_usleep((st_utime_t)(error_seconds * 1000 * 1000));
+            st_usleep((st_utime_t)BuildErrorMTime() * 1000);
             continue;
         }
         
-        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0);
+        int sleep_ms = StUtility::BuildRandomMTime((delay_seconds >= 0)? delay_seconds:0, &delay_seed);
         Trace("[RTMP] %s publish success, sleep %dms", url.GetUrl(), sleep_ms);
         st_usleep(sleep_ms * 1000);
         
@@ -34,11 +34,22 @@ class StRtmpTask : public StBaseTask
 {
 private:
     RtmpUrl url;
+    // the media packets to play then reconnect, 0 to never reconnect.
+    int packets;
+    // the annex-b file to dump the received video, empty to disable.
+    std::string dump_video;
+    // the ms without new video to detect the freeze, 0 to disable.
+    int freeze_ms;
+    // whether validate the received h.264 is decodable.
+    bool validate;
 public:
     StRtmpTask();
     virtual ~StRtmpTask();
 public:
-    virtual int Initialize(std::string http_url, double startup, double delay, double error, int count);
+    virtual int Initialize(std::string http_url, double startup, double delay, double error, int count, 
+        int packets, std::string dump_video, int freeze_ms);
+    // validate the received h.264, fail the task when corrupt.
+    virtual void SetValidate(bool validate);
 protected:
     virtual Uri* GetUri();
     virtual int ProcessTask();
@@ -66,12 +77,22 @@ class StRtmpPublishTask : public StBaseTask
 private:
     std::string input_flv_file;
     RtmpUrl url;
+    bool audio;
+    bool video;
+    int bitrate;
+    // switch to another flv after the seconds of publish, empty to disable.
+    std::string switch_input;
+    double switch_seconds;
 public:
     StRtmpPublishTask();
     virtual ~StRtmpPublishTask();
 public:
     virtual int Initialize(std::string input, 
-        std::string http_url, double startup, double delay, double error, int count);
+        std::string http_url, double startup, double delay, double error, int count, bool audio, bool video);
+    // set the target video bitrate in kbps, 0 to publish as is.
+    virtual void SetBitrate(int kbps);
+    // switch to another flv after the seconds of each publish, to change the sps/pps.
+    virtual void SetSwitch(std::string input, double seconds);
 protected:
     virtual Uri* GetUri();
     virtual int ProcessTask();
@@ -25,6 +25,7 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 #include <inttypes.h>
 #include <assert.h>
+#include <string.h>
 
 #include <string>
 #include <sstream>
@@ -35,48 +36,653 @@ using namespace std;
 
 #include <htl_app_rtmp_play.hpp>
 #include <htl_app_rtmp_protocol.hpp>
+#include <htl_app_flv_codec.hpp>
 #include <htl_app_srs_hijack.hpp>
 
 #define SOCK_READ_BUFFER 4096
 #define SOCK_READV_NB 1024
 #define SOCK_MERGED_READ_MS 800
+// the interval in ms to check the freeze and quality of players.
+#define PLAY_TICK_MS 1000
+
+static const char _start_code[] = {0x00, 0x00, 0x00, 0x01};
+
+StH264Dumper::StH264Dumper(){
+    f = NULL;
+    nalu_length = 4;
+    got_idr = false;
+    nb_frames = nb_bytes = 0;
+}
+
+StH264Dumper::~StH264Dumper(){
+    if(f){
+        fflush(f);
+        fclose(f);
+        Trace("[RTMP] dump video to %s, frames=%"PRId64", bytes=%"PRId64, path.c_str(), nb_frames, nb_bytes);
+    }
+}
+
+int StH264Dumper::Open(string path){
+    int ret = ERROR_SUCCESS;
+    
+    this->path = path;
+    
+    if((f = fopen(path.c_str(), "wb")) == NULL){
+        ret = ERROR_RTMP_DUMP_VIDEO;
+        Error("open dump video file %s failed. ret=%d", path.c_str(), ret);
+        return ret;
+    }
+    
+    return ret;
+}
+
+void StH264Dumper::Reset(){
+    got_idr = false;
+}
+
+int StH264Dumper::Write(char* data, int size){
+    int ret = ERROR_SUCCESS;
+    
+    // frame type, codec id, avc packet type and composition time.
+    if(size < 5 || (data[0] & 0x0f) != FlvCodecAVC){
+        return ret;
+    }
+    
+    char avc_packet_type = data[1];
+    data += 5;
+    size -= 5;
+    
+    // AVCDecoderConfigurationRecord, parse the sps and pps.
+    if(avc_packet_type == AvcSequenceHeader){
+        if(size < 6){
+            Warn("ignore the corrupt sequence header, size=%d", size);
+            return ret;
+        }
+        
+        // the lengthSizeMinusOne, the NALU length is 1, 2 or 4 bytes.
+        int length = (data[4] & 0x03) + 1;
+        if(length == 3){
+            Warn("ignore the corrupt sequence header, lengthSizeMinusOne=%d", length - 1);
+            return ret;
+        }
+        
+        std::vector<char> sequence;
+        int pos = 5;
+        for(int i = 0; i < 2; i++){
+            if(pos >= size){
+                Warn("ignore the corrupt sequence header, size=%d", size);
+                return ret;
+            }
+            
+            // the number of sps is 5bits, pps is 8bits.
+            int nb_nalus = (i == 0)? (data[pos] & 0x1f) : (u_int8_t)data[pos];
+            pos++;
+            
+            for(int j = 0; j < nb_nalus; j++){
+                if(pos + 2 > size){
+                    Warn("ignore the corrupt sequence header, size=%d", size);
+                    return ret;
+                }
+                int nalu_size = ((u_int8_t)data[pos] << 8) | (u_int8_t)data[pos + 1];
+                pos += 2;
+                
+                if(nalu_size > size - pos){
+                    Warn("ignore the corrupt sequence header, size=%d", size);
+                    return ret;
+                }
+                sequence.insert(sequence.end(), _start_code, _start_code + sizeof(_start_code));
+                sequence.insert(sequence.end(), data + pos, data + pos + nalu_size);
+                pos += nalu_size;
+            }
+        }
+        
+        sps_pps = sequence;
+        nalu_length = length;
+        return ret;
+    }
+    
+    if(avc_packet_type != AvcNALU){
+        return ret;
+    }
+    
+    std::vector<char> frame;
+    bool has_idr = false;
+    if(!Demux(data, size, nalu_length, frame, has_idr)){
+        Warn("drop the corrupt frame, size=%d", size);
+        return ret;
+    }
+    
+    // wait for the first IDR, for the frames before it are undecodable.
+    if(!got_idr && (!has_idr || sps_pps.empty())){
+        return ret;
+    }
+    got_idr = true;
+    
+    if(has_idr){
+        frame.insert(frame.begin(), sps_pps.begin(), sps_pps.end());
+    }
+    
+    if(!frame.empty() && fwrite(&frame[0], 1, frame.size(), f) != frame.size()){
+        ret = ERROR_RTMP_DUMP_VIDEO;
+        Error("write dump video file %s failed. ret=%d", path.c_str(), ret);
+        return ret;
+    }
+    
+    nb_frames++;
+    nb_bytes += frame.size();
+    
+    return ret;
+}
+
+bool StH264Dumper::Demux(char* data, int size, int nalu_length, std::vector<char>& frame, bool& has_idr){
+    int pos = 0;
+    
+    while(pos < size){
+        if(pos + nalu_length > size){
+            return false;
+        }
+        
+        int nalu_size = 0;
+        for(int i = 0; i < nalu_length; i++){
+            nalu_size = (nalu_size << 8) | (u_int8_t)data[pos + i];
+        }
+        pos += nalu_length;
+        
+        if(nalu_size <= 0 || nalu_size > size - pos){
+            return false;
+        }
+        
+        if((data[pos] & 0x1f) == NaluTypeIDR){
+            has_idr = true;
+        }
+        
+        frame.insert(frame.end(), _start_code, _start_code + sizeof(_start_code));
+        frame.insert(frame.end(), data + pos, data + pos + nalu_size);
+        pos += nalu_size;
+    }
+    
+    return true;
+}
+
+StH264Validator::StH264Validator(){
+    got_sps = got_pps = got_idr = false;
+    nalu_length = 4;
+    nb_complete = nb_incomplete = 0;
+    error = ERROR_SUCCESS;
+}
+
+StH264Validator::~StH264Validator(){
+    if(nb_complete > 0 || nb_incomplete > 0){
+        Trace("[RTMP] validate video, complete=%"PRId64", incomplete=%"PRId64, nb_complete, nb_incomplete);
+    }
+}
+
+void StH264Validator::Reset(){
+    got_sps = got_pps = got_idr = false;
+    nalu_length = 4;
+    nb_complete = nb_incomplete = 0;
+    error = ERROR_SUCCESS;
+}
+
+int StH264Validator::Write(char* data, int size){
+    int ret = ERROR_SUCCESS;
+    
+    if((ret = Validate(data, size)) != ERROR_SUCCESS){
+        error = ret;
+        return ret;
+    }
+    
+    return ret;
+}
+
+int StH264Validator::Validate(char* data, int size){
+    int ret = ERROR_SUCCESS;
+    
+    // frame type, codec id, avc packet type and composition time.
+    if(size < 5 || (data[0] & 0x0f) != FlvCodecAVC){
+        return ret;
+    }
+    
+    char avc_packet_type = data[1];
+    data += 5;
+    size -= 5;
+    
+    // AVCDecoderConfigurationRecord, check the sps and pps.
+    if(avc_packet_type == AvcSequenceHeader){
+        if(size < 6){
+            ret = ERROR_RTMP_H264_SEQUENCE;
+            Error("validate video failed, sequence header too small, size=%d. ret=%d", size, ret);
+            return ret;
+        }
+        
+        // the lengthSizeMinusOne, the NALU length is 1, 2 or 4 bytes.
+        nalu_length = (data[4] & 0x03) + 1;
+        if(nalu_length == 3){
+            ret = ERROR_RTMP_H264_SEQUENCE;
+            Error("validate video failed, invalid lengthSizeMinusOne=%d. ret=%d", nalu_length - 1, ret);
+            return ret;
+        }
+        
+        int pos = 5;
+        for(int i = 0; i < 2; i++){
+            if(pos >= size){
+                ret = ERROR_RTMP_H264_SEQUENCE;
+                Error("validate video failed, sequence header no %s, size=%d. ret=%d", (i == 0)? "sps":"pps", size, ret);
+                return ret;
+            }
+            
+            // the number of sps is 5bits, pps is 8bits.
+            int nb_nalus = (i == 0)? (data[pos] & 0x1f) : (u_int8_t)data[pos];
+            pos++;
+            
+            for(int j = 0; j < nb_nalus; j++){
+                int nalu_size = (pos + 2 <= size)? (((u_int8_t)data[pos] << 8) | (u_int8_t)data[pos + 1]) : 0;
+                pos += 2;
+                
+                if(nalu_size <= 0 || nalu_size > size - pos){
+                    ret = ERROR_RTMP_H264_SEQUENCE;
+                    Error("validate video failed, corrupt %s #%d, size=%d. ret=%d", (i == 0)? "sps":"pps", j, nalu_size, ret);
+                    return ret;
+                }
+                if((ret = CheckNalu(data + pos, nalu_size)) != ERROR_SUCCESS){
+                    return ret;
+                }
+                pos += nalu_size;
+            }
+        }
+        return ret;
+    }
+    
+    if(avc_packet_type != AvcNALU){
+        return ret;
+    }
+    
+    bool complete = true, has_idr = false;
+    for(int pos = 0; pos < size;){
+        if(pos + nalu_length > size){
+            complete = false;
+            break;
+        }
+        
+        int nalu_size = 0;
+        for(int i = 0; i < nalu_length; i++){
+            nalu_size = (nalu_size << 8) | (u_int8_t)data[pos + i];
+        }
+        pos += nalu_length;
+        
+        if(nalu_size <= 0 || nalu_size > size - pos){
+            complete = false;
+            break;
+        }
+        
+        if((ret = CheckNalu(data + pos, nalu_size)) != ERROR_SUCCESS){
+            return ret;
+        }
+        has_idr = has_idr || (data[pos] & 0x1f) == NaluTypeIDR;
+        pos += nalu_size;
+    }
+    
+    if(has_idr && (!got_sps || !got_pps)){
+        ret = ERROR_RTMP_H264_NO_SEQUENCE;
+        Error("validate video failed, IDR before SPS/PPS, sps=%d, pps=%d. ret=%d", got_sps, got_pps, ret);
+        return ret;
+    }
+    
+    // the frames before the first IDR are undecodable, ignore them.
+    got_idr = got_idr || has_idr;
+    if(!got_idr){
+        return ret;
+    }
+    
+    if(complete){
+        nb_complete++;
+    }else{
+        nb_incomplete++;
+        Warn("validate video, incomplete frame, size=%d", size);
+    }
+    statistic->OnVideoFrame(context->GetId(), complete);
+    
+    return ret;
+}
+
+int StH264Validator::Check(){
+    int ret = ERROR_SUCCESS;
+    
+    if(error != ERROR_SUCCESS){
+        ret = error;
+    }else if(nb_complete <= 0){
+        ret = ERROR_RTMP_H264_NO_FRAME;
+        Error("validate video failed, no complete frame, sps=%d, pps=%d, idr=%d, incomplete=%"PRId64". ret=%d", 
+            got_sps, got_pps, got_idr, nb_incomplete, ret);
+    }
+    
+    // stat the result, for the error of task is ignored when quit.
+    statistic->OnVideoValidate(context->GetId(), ret == ERROR_SUCCESS);
+    
+    return ret;
+}
+
+int StH264Validator::CheckNalu(char* data, int size){
+    int ret = ERROR_SUCCESS;
+    
+    // the forbidden_zero_bit must be 0.
+    if((data[0] & 0x80) != 0){
+        ret = ERROR_RTMP_H264_FORBIDDEN_BIT;
+        Error("validate video failed, forbidden_zero_bit is 1, nalu=%#x, size=%d. ret=%d", (u_int8_t)data[0], size, ret);
+        return ret;
+    }
+    
+    int nalu_type = data[0] & 0x1f;
+    if(nalu_type == 0 || nalu_type > NaluTypeMax){
+        ret = ERROR_RTMP_H264_NALU_TYPE;
+        Error("validate video failed, invalid nal_unit_type %d, size=%d. ret=%d", nalu_type, size, ret);
+        return ret;
+    }
+    
+    got_sps = got_sps || nalu_type == NaluTypeSPS;
+    got_pps = got_pps || nalu_type == NaluTypePPS;
+    
+    return ret;
+}
+
+std::set<StPlayStat*> StPlayStat::stats;
+bool StPlayStat::ticking = false;
+
+StPlayStat::StPlayStat(){
+    tid = 0;
+    playing = false;
+    connect_time = 0;
+    first_packet_ms = first_audio_ms = first_video_ms = -1;
+    freeze_ms = 0;
+    last_video_timestamp = 0;
+    last_video_time = -1;
+    freezing = false;
+    second_start = second_bytes = 0;
+    second_frames = 0;
+    
+    stats.insert(this);
+}
+
+StPlayStat::~StPlayStat(){
+    stats.erase(this);
+}
+
+void StPlayStat::SetFreeze(int freeze_ms){
+    this->freeze_ms = freeze_ms;
+}
+
+void StPlayStat::OnConnect(int64_t connect_time){
+    this->connect_time = connect_time;
+    tid = context->GetId();
+    playing = true;
+    first_packet_ms = first_audio_ms = first_video_ms = -1;
+    last_video_time = -1;
+    freezing = false;
+    second_start = second_bytes = 0;
+    second_frames = 0;
+    
+    // start the tick thread when the first player connect, ignore the error
+    // for only the ongoing freeze and stalled quality are not checked.
+    if(!ticking && st_thread_create(tick_cycle, NULL, 0, 0) != NULL){
+        ticking = true;
+    }
+}
+
+void StPlayStat::OnPacket(char type){
+    int64_t duration = -1;
+    
+    // ignore the messages except media, ie. the onStatus of play.
+    if(type != 0 && type != SRS_RTMP_TYPE_AUDIO && type != SRS_RTMP_TYPE_VIDEO){
+        return;
+    }
+    
+    if(first_packet_ms < 0){
+        duration = StUtility::GetCurrentTime() - connect_time;
+        first_packet_ms = duration;
+        statistic->OnFirstPacket(context->GetId(), duration);
+        Event("first_packet", "[PLAY] got first packet in %"PRId64"ms", duration);
+    }
+    
+    if(type == SRS_RTMP_TYPE_AUDIO && first_audio_ms < 0){
+        first_audio_ms = (duration >= 0)? duration : StUtility::GetCurrentTime() - connect_time;
+        statistic->OnFirstAudio(context->GetId(), first_audio_ms);
+    }
+    
+    if(type == SRS_RTMP_TYPE_VIDEO && first_video_ms < 0){
+        first_video_ms = (duration >= 0)? duration : StUtility::GetCurrentTime() - connect_time;
+        statistic->OnFirstVideo(context->GetId(), first_video_ms);
+    }
+}
+
+void StPlayStat::OnVideo(u_int32_t timestamp, char* data, int size){
+    int64_t now = StUtility::GetCurrentTime();
+    
+    if(second_start <= 0){
+        second_start = now;
+    }
+    second_bytes += size;
+    
+    // check the sequence header before update the last video, to get the gap of change.
+    if(size >= 5 && (data[0] & 0x0f) == FlvCodecAVC && data[1] == AvcSequenceHeader){
+        CheckSequence(now, timestamp, data + 5, size - 5);
+    }
+    
+    // a new frame when timestamp changed, never compare by order for the timestamp maybe rollover.
+    if(last_video_time < 0 || timestamp != last_video_timestamp){
+        CheckFreeze(now);
+        
+        second_frames++;
+        last_video_timestamp = timestamp;
+        last_video_time = now;
+    }
+    
+    if(now - second_start >= 1000){
+        ReportQuality(now);
+    }
+}
+
+void StPlayStat::OnClose(){
+    CheckFreeze(StUtility::GetCurrentTime());
+    playing = false;
+}
+
+void StPlayStat::OnTick(int64_t now){
+    if(!playing){
+        return;
+    }
+    
+    // the video is stalled, report the quality of the second without video.
+    if(second_start > 0 && now - second_start >= 1000){
+        ReportQuality(now);
+    }
+    
+    if(freeze_ms <= 0 || last_video_time < 0){
+        return;
+    }
+    
+    // count the freeze when it starts, and update the duration until it ends.
+    int64_t duration = now - last_video_time;
+    if(duration > freeze_ms && !freezing){
+        freezing = true;
+        statistic->OnFreeze(tid, duration);
+        Trace("[PLAY] client %d video freezing for %"PRId64"ms, timestamp=%u", tid, duration, last_video_timestamp);
+    }else if(freezing){
+        statistic->OnFreezing(tid, duration);
+    }
+}
+
+void StPlayStat::CheckFreeze(int64_t now){
+    if(freeze_ms <= 0 || last_video_time < 0){
+        return;
+    }
+    
+    int64_t duration = now - last_video_time;
+    if(freezing){
+        statistic->OnFreezing(tid, duration);
+    }else if(duration > freeze_ms){
+        statistic->OnFreeze(tid, duration);
+    }
+    
+    if(freezing || duration > freeze_ms){
+        Event("freeze", "[PLAY] video freeze for %"PRId64"ms, timestamp=%u", duration, last_video_timestamp);
+    }
+    freezing = false;
+}
+
+void StPlayStat::CheckSequence(int64_t now, u_int32_t timestamp, char* data, int size){
+    std::string header(data, size);
+    
+    // the first sequence header, or the same one sent again, ie. when reconnect.
+    if(sequence_header.empty() || header == sequence_header){
+        sequence_header = header;
+        return;
+    }
+    sequence_header = header;
+    
+    // the gap of video around the change, since the last frame or connect.
+    int64_t gap = now - ((last_video_time >= 0)? last_video_time : connect_time);
+    statistic->OnSequenceChange(tid, gap);
+    Event("sequence_change", "[PLAY] h.264 sps/pps changed, timestamp=%u, last_timestamp=%u, gap=%"PRId64"ms", 
+        timestamp, last_video_timestamp, gap);
+}
+
+void StPlayStat::ReportQuality(int64_t now){
+    int kbps = (int)(second_bytes * 8 / (now - second_start));
+    int fps = (int)(second_frames * 1000 / (now - second_start));
+    statistic->OnVideoQuality(tid, kbps, fps);
+    Info("[PLAY] video bitrate %dkbps, fps=%d", kbps, fps);
+    
+    second_start = now;
+    second_bytes = 0;
+    second_frames = 0;
+}
+
+void* StPlayStat::tick_cycle(void* /*args*/){
+    for(;;){
+        int64_t now = StUtility::GetCurrentTime();
+        for(std::set<StPlayStat*>::iterator it = stats.begin(); it != stats.end(); ++it){
+            (*it)->OnTick(now);
+        }
+        
+        st_usleep(PLAY_TICK_MS * 1000);
+    }
+    
+    return NULL;
+}
 
 StRtmpPlayClient::StRtmpPlayClient(){
     stream_id = 0;
+    packets = 0;
     srs = NULL;
+    dumper = NULL;
+    validator = NULL;
+    connect_time = 0;
+    tcp_ms = handshake_ms = connect_app_ms = play_ms = -1;
 }
 
 StRtmpPlayClient::~StRtmpPlayClient(){
     srs_rtmp_destroy(srs);
+    
+    if(dumper){
+        delete dumper;
+        dumper = NULL;
+    }
+    
+    if(validator){
+        delete validator;
+        validator = NULL;
+    }
+}
+
+int StRtmpPlayClient::DumpVideo(string path){
+    int ret = ERROR_SUCCESS;
+    
+    if(dumper){
+        delete dumper;
+    }
+    dumper = new StH264Dumper();
+    
+    if((ret = dumper->Open(path)) != ERROR_SUCCESS){
+        return ret;
+    }
+    
+    return ret;
+}
+
+void StRtmpPlayClient::ValidateVideo(){
+    if(!validator){
+        validator = new StH264Validator();
+    }
+}
+
+void StRtmpPlayClient::SetFreeze(int freeze_ms){
+    stat.SetFreeze(freeze_ms);
 }
 
-int StRtmpPlayClient::Dump(RtmpUrl* url){
+int StRtmpPlayClient::Dump(RtmpUrl* url, int packets){
     int ret = ERROR_SUCCESS;
     
+    this->packets = packets;
+    
+    if(dumper){
+        dumper->Reset();
+    }
+    if(validator){
+        validator->Reset();
+    }
+    connect_time = StUtility::GetCurrentTime();
+    tcp_ms = handshake_ms = connect_app_ms = play_ms = -1;
+    stat.OnConnect(connect_time);
+    
     if((ret = Connect(url)) != ERROR_SUCCESS){
         Error("rtmp client connect server failed. ret=%d", ret);
         return ret;
     }
+    tcp_ms = StUtility::GetCurrentTime() - connect_time;
     
     if((ret = Handshake()) != ERROR_SUCCESS){
         Error("rtmp client handshake failed. ret=%d", ret);
         return ret;
     }
+    handshake_ms = StUtility::GetCurrentTime() - connect_time;
     Info("rtmp client handshake success");
     
     if((ret = ConnectApp()) != ERROR_SUCCESS){
         Error("rtmp client connect tcUrl failed. ret=%d", ret);
         return ret;
     }
+    connect_app_ms = StUtility::GetCurrentTime() - connect_time;
     Info("rtmp client connect tcUrl(%s) success", url->GetTcUrl());
     
     if((ret = PlayStram()) != ERROR_SUCCESS){
         Error("rtmp client play stream failed. ret=%d", ret);
         return ret;
     }
-    Info("rtmp client play stream(%s) success", url->GetUrl());
+    play_ms = StUtility::GetCurrentTime() - connect_time;
+    statistic->OnSetup(context->GetId(), play_ms);
+    Event("play", "rtmp client play stream(%s) success in %"PRId64"ms", url->GetUrl(), play_ms);
+    
+    ret = DumpAV();
+    stat.OnClose();
+    
+    // the play is interrupted by quit, it's done rather than failed.
+    if(ret != ERROR_SUCCESS && StFarm::IsQuit()){
+        ret = ERROR_SUCCESS;
+    }
+    
+    // when play done or failed, the stream must be decodable, and the error of play is kept.
+    // the stream interrupted by quit is incomplete, never validate it.
+    if(validator && !StFarm::IsQuit()){
+        int check_ret = validator->Check();
+        ret = (ret == ERROR_SUCCESS)? check_ret : ret;
+    }
+    ReportStartup(url);
+    
+    // close the connection, for the churn mode will sleep then reconnect.
+    srs_rtmp_destroy(srs);
+    srs = NULL;
     
-    if((ret = DumpAV()) != ERROR_SUCCESS){
+    if(ret != ERROR_SUCCESS){
         Error("rtmp client dump av failed. ret=%d", ret);
         return ret;
     }
@@ -121,8 +727,10 @@ int StRtmpPlayClient::PlayStram(){
 int StRtmpPlayClient::DumpAV(){
     int ret = ERROR_SUCCESS;
 
+    int nb_media = 0;
+    
     // recv response
-    while(true){
+    while(packets == 0 || nb_media < packets){
         char type;
         u_int32_t timestamp;
         char* data;
@@ -133,12 +741,37 @@ int StRtmpPlayClient::DumpAV(){
         }
         
         Info("get message type=%d, size=%d", type, size);
+        
+        if(dumper && type == SRS_RTMP_TYPE_VIDEO && (ret = dumper->Write(data, size)) != ERROR_SUCCESS){
+            delete data;
+            return ret;
+        }
+        if(validator && type == SRS_RTMP_TYPE_VIDEO && (ret = validator->Write(data, size)) != ERROR_SUCCESS){
+            delete data;
+            return ret;
+        }
+        
+        if(type == SRS_RTMP_TYPE_VIDEO){
+            stat.OnVideo(timestamp, data, size);
+        }
         delete data;
+        
+        if(type == SRS_RTMP_TYPE_AUDIO || type == SRS_RTMP_TYPE_VIDEO){
+            nb_media++;
+        }
+        
+        stat.OnPacket(type);
     }
     
     return ret;
 }
 
+void StRtmpPlayClient::ReportStartup(RtmpUrl* url){
+    Event("startup", "[RTMP] %s startup tcp=%"PRId64"ms, handshake=%"PRId64"ms, connect=%"PRId64"ms, play=%"PRId64"ms, "
+        "first_packet=%"PRId64"ms, first_audio=%"PRId64"ms, first_video=%"PRId64"ms", url->GetUrl(), 
+        tcp_ms, handshake_ms, connect_app_ms, play_ms, stat.first_packet_ms, stat.first_audio_ms, stat.first_video_ms);
+}
+
 StRtmpPlayClientFast::StRtmpPlayClientFast(){
 }
 
@@ -168,6 +801,8 @@ int StRtmpPlayClientFast::DumpAV(){
         }
         
         Info("get message size=%d", size);
+        
+        stat.OnPacket(0);
 
         // merged read.
         st_usleep(SOCK_MERGED_READ_MS * 1000);
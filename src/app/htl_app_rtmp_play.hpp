@@ -27,29 +27,182 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 /*
 #include <htl_app_rtmp_play.hpp>
 */
+#include <stdio.h>
+
 #include <string>
+#include <vector>
+#include <set>
 
 #include <htl_core_uri.hpp>
 #include <htl_os_st.hpp>
 
 #include <htl_app_rtmp_protocol.hpp>
 
+/**
+* dump the h.264 in FLV video tags to annex-b file, which can be played by ffprobe/ffplay.
+* the sps/pps in sequence header is written before each IDR,
+* and the frames before the first IDR are dropped.
+*/
+class StH264Dumper
+{
+private:
+    FILE* f;
+    std::string path;
+    // the sps/pps from the sequence header, in annex-b.
+    std::vector<char> sps_pps;
+    // the size of NALU length in frame, the lengthSizeMinusOne+1 of sequence header.
+    int nalu_length;
+    bool got_idr;
+    int64_t nb_frames, nb_bytes;
+public:
+    StH264Dumper();
+    virtual ~StH264Dumper();
+public:
+    virtual int Open(std::string path);
+    // when reconnect, the stream restart, so wait for IDR again.
+    virtual void Reset();
+    // write the data of FLV video tag, ignore the codecs except h.264.
+    virtual int Write(char* data, int size);
+private:
+    // demux the avc NALUs to annex-b, false if the frame is corrupt.
+    virtual bool Demux(char* data, int size, int nalu_length, std::vector<char>& frame, bool& has_idr);
+};
+
+/**
+* validate the h.264 in FLV video tags is decodable, not only count the packets.
+* check the syntax of NALUs, the sps/pps must arrive before the first IDR,
+* and at least one complete frame is got, where the frame of RTMP is a video tag.
+*/
+class StH264Validator
+{
+private:
+    bool got_sps, got_pps, got_idr;
+    // the size of NALU length in frame, the lengthSizeMinusOne+1 of sequence header.
+    int nalu_length;
+    // the frames after the first IDR, whether all NALUs are complete.
+    int64_t nb_complete, nb_incomplete;
+    // the error when validate the stream, ERROR_SUCCESS if valid.
+    int error;
+public:
+    StH264Validator();
+    virtual ~StH264Validator();
+public:
+    // when reconnect, the stream restart, so wait for sps/pps and IDR again.
+    virtual void Reset();
+    // validate the data of FLV video tag, ignore the codecs except h.264.
+    virtual int Write(char* data, int size);
+    // when play done, check whether the stream is valid and got any complete frame.
+    virtual int Check();
+private:
+    virtual int Validate(char* data, int size);
+    virtual int CheckNalu(char* data, int size);
+};
+
+/**
+* the statistic of a player, shared by the RTMP and HTTP-FLV players,
+* for the messages of RTMP are the tags of FLV.
+*/
+class StPlayStat
+{
+public:
+    // the duration in ms since connect of the first packet, -1 if not got.
+    int64_t first_packet_ms, first_audio_ms, first_video_ms;
+private:
+    // the id of client, for the stat is checked by the tick thread.
+    int tid;
+    // whether the client is playing, only tick the playing stat.
+    bool playing;
+    // the time in ms when start to connect.
+    int64_t connect_time;
+    // the video freeze when no new video timestamp for the ms, 0 to disable.
+    int freeze_ms;
+    // the timestamp of last video, and the time in ms when got it, -1 if no video.
+    u_int32_t last_video_timestamp;
+    int64_t last_video_time;
+    // whether the video is freezing, which is already counted.
+    bool freezing;
+    // the video of current second, to stat the bitrate and fps.
+    int64_t second_start, second_bytes;
+    int second_frames;
+    // the content of last h.264 sequence header, to detect the sps/pps change.
+    // kept when reconnect, for the change maybe happens when the player is dropped.
+    std::string sequence_header;
+private:
+    // the stats of all players, checked by the tick thread.
+    static std::set<StPlayStat*> stats;
+    static bool ticking;
+public:
+    StPlayStat();
+    virtual ~StPlayStat();
+public:
+    /**
+    * detect the video freeze, when got no new video timestamp for the ms.
+    */
+    virtual void SetFreeze(int freeze_ms);
+    // when start to connect, reset the stat of last connection.
+    virtual void OnConnect(int64_t connect_time);
+    // when got packet, the type is SRS_RTMP_TYPE_AUDIO/VIDEO, or 0 for unknown.
+    virtual void OnPacket(char type);
+    // when got video, stat the bitrate, fps, freeze and the sps/pps change.
+    virtual void OnVideo(u_int32_t timestamp, char* data, int size);
+    // when close, check whether video freezed until now.
+    virtual void OnClose();
+    /**
+    * check the ongoing freeze and the video quality, for the player
+    * is blocked to read when no video, so it's invoked by the tick thread.
+    */
+    virtual void OnTick(int64_t now);
+private:
+    virtual void CheckFreeze(int64_t now);
+    virtual void CheckSequence(int64_t now, u_int32_t timestamp, char* data, int size);
+    virtual void ReportQuality(int64_t now);
+    static void* tick_cycle(void* args);
+};
+
 class StRtmpPlayClient
 {
 protected:
     srs_rtmp_t srs;
     int stream_id;
+    // the media packets to play then close, 0 to play forever.
+    int packets;
+    // the time in ms when start to connect, to stat the startup.
+    int64_t connect_time;
+    // the duration in ms since connect of each startup stage, -1 if not reached.
+    int64_t tcp_ms, handshake_ms, connect_app_ms, play_ms;
+    StPlayStat stat;
+    // the dumper for received video, NULL to disable.
+    StH264Dumper* dumper;
+    // the validator for received video, NULL to disable.
+    StH264Validator* validator;
 public:
     StRtmpPlayClient();
     virtual ~StRtmpPlayClient();
 public:
-    virtual int Dump(RtmpUrl* url);
+    /**
+    * dump the received h.264 to the annex-b file, appended for each Dump.
+    */
+    virtual int DumpVideo(std::string path);
+    /**
+    * validate the received h.264 is decodable, fail when corrupt.
+    */
+    virtual void ValidateVideo();
+    /**
+    * detect the video freeze, when got no new video timestamp for the ms.
+    */
+    virtual void SetFreeze(int freeze_ms);
+    /**
+    * play the url until error, or got the packets of media.
+    * @param packets the media packets to play then close, 0 to play forever.
+    */
+    virtual int Dump(RtmpUrl* url, int packets);
 protected:
     virtual int Connect(RtmpUrl* url);
     virtual int Handshake();
     virtual int ConnectApp();
     virtual int PlayStram();
     virtual int DumpAV();
+    virtual void ReportStartup(RtmpUrl* url);
 };
 
 class StRtmpPlayClientFast : public StRtmpPlayClient
@@ -25,9 +25,13 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 #include <inttypes.h>
 #include <assert.h>
+#include <stdio.h>
 
+#include <map>
+#include <vector>
 #include <string>
 #include <sstream>
+#include <algorithm>
 using namespace std;
 
 #include <htl_core_error.hpp>
@@ -35,19 +39,315 @@ using namespace std;
 
 #include <htl_app_rtmp_publish.hpp>
 #include <htl_app_rtmp_protocol.hpp>
+#include <htl_app_flv_codec.hpp>
+
+// the validated size of flv files, -1 means the whole file is valid.
+static map<string, int64_t> _flv_valid_sizes;
+
+// the window to hold the average bitrate, in ms.
+#define SHAPER_WINDOW_MS 10000
+// the max ms to wait for a frame, the lost budget is never recovered.
+#define SHAPER_MAX_WAIT_MS 1000
+
+int StFlvSource::Validate(string input, bool truncate){
+    int ret = ERROR_SUCCESS;
+    
+    if(_flv_valid_sizes.find(input) != _flv_valid_sizes.end()){
+        return ret;
+    }
+    
+    FILE* f = fopen(input.c_str(), "rb");
+    if(!f){
+        ret = ERROR_RTMP_OPEN_FLV;
+        Error("open flv file %s failed. ret=%d", input.c_str(), ret);
+        return ret;
+    }
+    
+    // the offset of the end of last good tag.
+    int64_t valid_size = 0;
+    int64_t index = 0;
+    const char* reason = NULL;
+    
+    char header[FLV_HEADER_SIZE + FLV_PREVIOUS_TAG_SIZE];
+    if(fread(header, 1, sizeof(header), f) != sizeof(header)){
+        reason = "flv header truncated";
+    } else if(header[0] != 'F' || header[1] != 'L' || header[2] != 'V'){
+        reason = "flv header must start with FLV";
+    }
+    
+    if(!reason){
+        valid_size = sizeof(header);
+    }
+    
+    vector<char> data;
+    while(!reason){
+        u_int8_t th[FLV_TAG_HEADER_SIZE];
+        size_t nread = fread(th, 1, sizeof(th), f);
+        
+        // EOF at tag boundary, all tags are ok.
+        if(nread == 0 && feof(f)){
+            break;
+        }
+        if(nread != sizeof(th)){
+            reason = "tag header truncated";
+            break;
+        }
+        
+        u_int8_t type = th[0] & 0x1F;
+        if(type != SRS_RTMP_TYPE_AUDIO && type != SRS_RTMP_TYPE_VIDEO && type != SRS_RTMP_TYPE_SCRIPT){
+            reason = "invalid tag type";
+            break;
+        }
+        
+        // StreamID UI24, always 0.
+        if(th[8] != 0 || th[9] != 0 || th[10] != 0){
+            reason = "stream id must be 0";
+            break;
+        }
+        
+        int32_t size = (th[1] << 16) | (th[2] << 8) | th[3];
+        data.resize(size + FLV_PREVIOUS_TAG_SIZE);
+        if(fread(&data[0], 1, data.size(), f) != data.size()){
+            reason = "tag data truncated";
+            break;
+        }
+        
+        u_int8_t* pts = (u_int8_t*)&data[size];
+        int32_t previous_tag_size = (pts[0] << 24) | (pts[1] << 16) | (pts[2] << 8) | pts[3];
+        if(previous_tag_size != size + FLV_TAG_HEADER_SIZE){
+            reason = "previous tag size mismatch";
+            break;
+        }
+        
+        valid_size += FLV_TAG_HEADER_SIZE + data.size();
+        index++;
+    }
+    fclose(f);
+    
+    if(!reason){
+        _flv_valid_sizes[input] = -1;
+        Trace("validate flv %s ok, tags=%"PRId64", size=%"PRId64, input.c_str(), index, valid_size);
+        return ret;
+    }
+    
+    ret = ERROR_RTMP_FLV_INVALID;
+    if(!truncate || index == 0){
+        Error("validate flv %s failed, %s at offset=%"PRId64", tag=%"PRId64". ret=%d", 
+            input.c_str(), reason, valid_size, index, ret);
+        return ret;
+    }
+    
+    _flv_valid_sizes[input] = valid_size;
+    Warn("validate flv %s, %s at offset=%"PRId64", tag=%"PRId64", truncate to the last good tag. ret=%d", 
+        input.c_str(), reason, valid_size, index, ret);
+    
+    return ERROR_SUCCESS;
+}
+
+int64_t StFlvSource::GetValidSize(string input){
+    map<string, int64_t>::iterator it = _flv_valid_sizes.find(input);
+    if(it == _flv_valid_sizes.end()){
+        return -1;
+    }
+    return it->second;
+}
+
+int StFlvSource::CheckMedia(string input, bool audio, bool video){
+    int ret = ERROR_SUCCESS;
+    
+    FILE* f = fopen(input.c_str(), "rb");
+    if(!f){
+        ret = ERROR_RTMP_OPEN_FLV;
+        Error("open flv file %s failed. ret=%d", input.c_str(), ret);
+        return ret;
+    }
+    
+    // only read the tag headers, skip the data and previous tag size.
+    bool found = false;
+    u_int8_t th[FLV_TAG_HEADER_SIZE];
+    if(fseek(f, FLV_HEADER_SIZE + FLV_PREVIOUS_TAG_SIZE, SEEK_SET) == 0){
+        while(!found && fread(th, 1, sizeof(th), f) == sizeof(th)){
+            u_int8_t type = th[0] & 0x1F;
+            found = (type == SRS_RTMP_TYPE_AUDIO && audio) || (type == SRS_RTMP_TYPE_VIDEO && video);
+            
+            int32_t size = (th[1] << 16) | (th[2] << 8) | th[3];
+            if(fseek(f, size + FLV_PREVIOUS_TAG_SIZE, SEEK_CUR) != 0){
+                break;
+            }
+        }
+    }
+    fclose(f);
+    
+    if(!found){
+        ret = ERROR_RTMP_FLV_NO_MEDIA;
+        Error("flv %s has no tag to publish, audio=%d, video=%d. ret=%d", input.c_str(), audio, video, ret);
+        return ret;
+    }
+    
+    return ret;
+}
+
+int64_t StFlvSource::GetMaxTagSize(string input){
+    FILE* f = fopen(input.c_str(), "rb");
+    if(!f){
+        return -1;
+    }
+    
+    // only read the tag headers, skip the data and previous tag size.
+    int64_t max_size = 0;
+    u_int8_t th[FLV_TAG_HEADER_SIZE];
+    if(fseek(f, FLV_HEADER_SIZE + FLV_PREVIOUS_TAG_SIZE, SEEK_SET) == 0){
+        while(fread(th, 1, sizeof(th), f) == sizeof(th)){
+            int32_t size = (th[1] << 16) | (th[2] << 8) | th[3];
+            max_size = std::max(max_size, (int64_t)size);
+            
+            if(fseek(f, size + FLV_PREVIOUS_TAG_SIZE, SEEK_CUR) != 0){
+                break;
+            }
+        }
+    }
+    fclose(f);
+    
+    return max_size;
+}
+
+StBitrateShaper::StBitrateShaper(){
+    target_kbps = 0;
+    window_start = window_bytes = 0;
+    second_start = second_bytes = 0;
+    second_frames = 0;
+    nb_dropped = 0;
+}
+
+StBitrateShaper::~StBitrateShaper(){
+}
+
+void StBitrateShaper::SetTarget(int kbps){
+    target_kbps = kbps;
+}
+
+bool StBitrateShaper::Shape(char* data, int size, int* pwait_ms){
+    *pwait_ms = 0;
+    
+    if(target_kbps <= 0){
+        return false;
+    }
+    
+    int64_t now = StUtility::GetCurrentTime();
+    if(window_start <= 0 || now - window_start >= SHAPER_WINDOW_MS){
+        window_start = now;
+        window_bytes = 0;
+    }
+    
+    // the bytes over the budget of window, kbps equals to bytes per 8ms.
+    int64_t budget = (now - window_start) * target_kbps / 8;
+    int64_t over = window_bytes + size - budget;
+    if(over <= 0){
+        return false;
+    }
+    
+    if(IsNonReference(data, size)){
+        nb_dropped++;
+        return true;
+    }
+    
+    // wait until the budget is enough for the frame.
+    int64_t wait_ms = over * 8 / target_kbps;
+    *pwait_ms = (int)((wait_ms < SHAPER_MAX_WAIT_MS)? wait_ms : SHAPER_MAX_WAIT_MS);
+    
+    return false;
+}
+
+void StBitrateShaper::OnSent(int size){
+    if(target_kbps <= 0){
+        return;
+    }
+    
+    window_bytes += size;
+    second_bytes += size;
+    second_frames++;
+    
+    int64_t now = StUtility::GetCurrentTime();
+    if(second_start <= 0){
+        second_start = now;
+    }
+    if(now - second_start >= 1000){
+        Report(now);
+    }
+}
+
+bool StBitrateShaper::IsNonReference(char* data, int size){
+    // frame type, codec id, avc packet type and composition time.
+    if(size < 5){
+        return false;
+    }
+    
+    int frame_type = (data[0] >> 4) & 0x0f;
+    if(frame_type == FlvDisposableFrame){
+        return true;
+    }
+    if(frame_type == FlvKeyFrame || (data[0] & 0x0f) != FlvCodecAVC || data[1] != AvcNALU){
+        return false;
+    }
+    
+    // all slices must be non-reference, the nal_ref_idc is 0, 
+    // assume the NALU length is 4 bytes, which is used by most encoders.
+    bool has_slice = false;
+    int pos = 5;
+    while(pos + 4 < size){
+        int nalu_size = ((u_int8_t)data[pos] << 24) | ((u_int8_t)data[pos + 1] << 16) 
+            | ((u_int8_t)data[pos + 2] << 8) | (u_int8_t)data[pos + 3];
+        pos += 4;
+        
+        if(nalu_size <= 0 || nalu_size > size - pos){
+            return false;
+        }
+        
+        u_int8_t nalu = (u_int8_t)data[pos];
+        if((nalu & 0x1f) == NaluTypeNonIDR){
+            if((nalu & 0x60) != 0){
+                return false;
+            }
+            has_slice = true;
+        }
+        pos += nalu_size;
+    }
+    
+    return has_slice;
+}
+
+void StBitrateShaper::Report(int64_t now){
+    int kbps = (int)(second_bytes * 8 / (now - second_start));
+    int fps = (int)(second_frames * 1000 / (now - second_start));
+    statistic->OnVideoQuality(context->GetId(), kbps, fps);
+    Trace("[RTMP] video bitrate %dkbps, fps=%d, target=%dkbps, dropped=%d", kbps, fps, target_kbps, nb_dropped);
+    
+    second_start = now;
+    second_bytes = 0;
+    second_frames = 0;
+    nb_dropped = 0;
+}
 
 StRtmpPublishClient::StRtmpPublishClient(){
     stream_id = 0;
     srs = NULL;
+    start_wallclock = 0;
+    start_dts = -1;
+    audio = video = true;
+    switch_ms = 0;
+    switched = false;
 }
 
 StRtmpPublishClient::~StRtmpPublishClient(){
     srs_rtmp_destroy(srs);
 }
 
-int StRtmpPublishClient::Publish(string input, RtmpUrl* url){
+int StRtmpPublishClient::Publish(string input, RtmpUrl* url, bool audio, bool video){
     int ret = ERROR_SUCCESS;
     
+    this->audio = audio;
+    this->video = video;
+    
     if((ret = Connect(url)) != ERROR_SUCCESS){
         Error("rtmp client connect server failed. ret=%d", ret);
         return ret;
@@ -69,7 +369,7 @@ int StRtmpPublishClient::Publish(string input, RtmpUrl* url){
         Error("rtmp client publish stream failed. ret=%d", ret);
         return ret;
     }
-    Info("rtmp client publish stream(%s) success", url->GetUrl());
+    Event("publish", "rtmp client publish stream(%s) success", url->GetUrl());
     
     srs_flv_t flv = srs_flv_open_read(input.c_str());
     if (!flv) {
@@ -78,25 +378,46 @@ int StRtmpPublishClient::Publish(string input, RtmpUrl* url){
         return ret;
     }
 
+    start_dts = -1;
+    int64_t valid_size = StFlvSource::GetValidSize(input);
+    switched = false;
+    
     int64_t timebase = 0;
     while (true) {
         int32_t starttime = -1;
         int32_t endtime = -1;
         
         // publish the whole av of flv file
-        ret = PublishAV(flv, timebase, &starttime, &endtime);
+        ret = PublishAV(flv, valid_size, timebase, &starttime, &endtime);
         
         // restart when flv EOF
-        if (srs_flv_is_eof(ret)) {
+        if (srs_flv_is_eof(ret) || ret == ERROR_RTMP_FLV_EOF) {
             srs_flv_lseek(flv, 0);
             timebase += endtime - starttime;
             Info("republish for flv EOF, timebase=%"PRId64", start=%d, end=%d, ret=%d", 
                 timebase, starttime, endtime, ret);
             continue;
         }
-        if (ret != ERROR_SUCCESS) {
-            break;
+        
+        // switch to another flv, the first tag of it follows the last tag.
+        if (ret == ERROR_RTMP_FLV_SWITCH) {
+            srs_flv_close(flv);
+            
+            u_int32_t switch_starttime = 0;
+            if ((ret = OpenSwitch(&flv, &switch_starttime)) != ERROR_SUCCESS) {
+                return ret;
+            }
+            switched = true;
+            
+            valid_size = StFlvSource::GetValidSize(switch_input);
+            timebase += endtime - (int64_t)switch_starttime;
+            Event("switch", "[RTMP] switch to flv %s, timebase=%"PRId64", end=%d, start=%u", 
+                switch_input.c_str(), timebase, endtime, switch_starttime);
+            continue;
         }
+        
+        // quit or error.
+        break;
     }
     srs_flv_close(flv);
     
@@ -109,6 +430,15 @@ int StRtmpPublishClient::Publish(string input, RtmpUrl* url){
     return ret;
 }
 
+void StRtmpPublishClient::SetBitrate(int kbps){
+    shaper.SetTarget(kbps);
+}
+
+void StRtmpPublishClient::SetSwitch(string input, double seconds){
+    switch_input = input;
+    switch_ms = (int64_t)(seconds * 1000);
+}
+
 int StRtmpPublishClient::Connect(RtmpUrl* url){
     int ret = ERROR_SUCCESS;
     
@@ -142,7 +472,7 @@ int StRtmpPublishClient::PublishStram(){
     return srs_rtmp_publish_stream(srs);
 }
 
-int StRtmpPublishClient::PublishAV(srs_flv_t flv, 
+int StRtmpPublishClient::PublishAV(srs_flv_t flv, int64_t valid_size, 
     int64_t timebase, int32_t* starttime, int32_t* endtime
 ){
     int ret = ERROR_SUCCESS;
@@ -154,12 +484,28 @@ int StRtmpPublishClient::PublishAV(srs_flv_t flv,
     }
 
     // open flv and publish to server.
-    u_int32_t re = 0;
     while(true){
         char type;
         u_int32_t timestamp;
         int32_t size;
         
+        // stop at tag boundary when quit.
+        if (StFarm::IsQuit()) {
+            return ret;
+        }
+        
+        // switch at tag boundary when published for a while, after a tag to get the endtime.
+        if (!switch_input.empty() && !switched && *endtime >= 0 && start_dts >= 0 
+            && StUtility::GetCurrentTime() - start_wallclock >= switch_ms
+        ) {
+            return ERROR_RTMP_FLV_SWITCH;
+        }
+        
+        // the tags after valid size are corrupt, treat as EOF.
+        if (valid_size > 0 && srs_flv_tellg(flv) >= valid_size) {
+            return ERROR_RTMP_FLV_EOF;
+        }
+        
         if ((ret = srs_flv_read_tag_header(flv, &type, &size, &timestamp)) != ERROR_SUCCESS) {
             return ret;
         }
@@ -176,42 +522,36 @@ int StRtmpPublishClient::PublishAV(srs_flv_t flv,
             return ret;
         }
         
-        // modify the duration to -1
-        if (type == SRS_RTMP_TYPE_SCRIPT) {
-            int nparsed = 0;
-            srs_amf0_t onMetaData = srs_amf0_parse(data, size, &nparsed);
-            srs_amf0_t metadata = srs_amf0_parse(data + nparsed, size - nparsed, &nparsed);
-            if (srs_amf0_is_ecma_array(metadata)) {
-                srs_amf0_t obj = srs_amf0_ecma_array_to_object(metadata);
-                srs_amf0_free(metadata);
-                metadata = obj;
-            }
-            if (srs_amf0_object_property(metadata, "duration")) {
-                srs_amf0_object_property_set(metadata, "duration", srs_amf0_create_number(-1));
-                
-                // serialize to bytes.
-                int nb_onMetaData = srs_amf0_size(onMetaData);
-                int nb_metadata = srs_amf0_size(metadata);
-                size = nb_onMetaData + nb_metadata;
-                
+        // drop the tags of the disabled kind, for audio-only or video-only stream.
+        if ((type == SRS_RTMP_TYPE_AUDIO && !audio) || (type == SRS_RTMP_TYPE_VIDEO && !video)) {
+            delete[] data;
+            continue;
+        }
+        
+        // shape the video to the target bitrate.
+        if (type == SRS_RTMP_TYPE_VIDEO) {
+            int wait_ms = 0;
+            if (shaper.Shape(data, size, &wait_ms)) {
                 delete[] data;
-                data = new char[size];
-                
-                ret = srs_amf0_serialize(onMetaData, data, nb_onMetaData);
-                if (ret == ERROR_SUCCESS) {
-                    ret = srs_amf0_serialize(metadata, data + nb_onMetaData, nb_metadata);
-                }
-                
-                srs_amf0_free(onMetaData);
-                srs_amf0_free(metadata);
+                continue;
+            }
+            if (wait_ms > 0) {
+                int64_t wait_start = StUtility::GetCurrentTime();
+                st_usleep((st_utime_t)(wait_ms * 1000));
                 
-                if (ret != ERROR_SUCCESS) {
-                    delete data;
-                    return ret;
+                // delay the pacer by the wait, or the tags after it are sent in a burst.
+                if (start_dts >= 0) {
+                    start_wallclock += StUtility::GetCurrentTime() - wait_start;
                 }
             }
         }
         
+        // modify the duration to -1, and remove the properties of disabled kind.
+        if (type == SRS_RTMP_TYPE_SCRIPT && (ret = RewriteMetadata(&data, &size)) != ERROR_SUCCESS) {
+            delete[] data;
+            return ret;
+        }
+        
         u_int32_t dts = (u_int32_t)(timebase + timestamp);
         if ((ret = srs_rtmp_write_packet(srs, type, dts, data, size)) != ERROR_SUCCESS) {
             return ret;
@@ -219,15 +559,133 @@ int StRtmpPublishClient::PublishAV(srs_flv_t flv,
         Info("send message type=%d, size=%d, time=%d, dts=%d", 
             type, size, timestamp, dts);
         
-        if (re <= 0) {
-            re = timestamp;
+        if (type == SRS_RTMP_TYPE_VIDEO) {
+            shaper.OnSent(size);
+        }
+        
+        if (start_dts < 0) {
+            start_dts = timebase + timestamp;
+            start_wallclock = StUtility::GetCurrentTime();
+        }
+        
+        // sleep until the wallclock of tag, merged by 300ms.
+        int64_t deadline = start_wallclock + (timebase + timestamp - start_dts);
+        int64_t ahead = deadline - StUtility::GetCurrentTime();
+        if (ahead > 300) {
+            st_usleep((st_utime_t)(ahead * 1000));
+        }
+    }
+    
+    return ret;
+}
+
+int StRtmpPublishClient::OpenSwitch(srs_flv_t* pflv, u_int32_t* pstarttime){
+    int ret = ERROR_SUCCESS;
+    
+    srs_flv_t flv = srs_flv_open_read(switch_input.c_str());
+    if (!flv) {
+        ret = ERROR_RTMP_OPEN_FLV;
+        Error("open switch flv file %s failed. ret=%d", switch_input.c_str(), ret);
+        return ret;
+    }
+    
+    // read the timestamp of first tag, then rewind for PublishAV.
+    char header[9];
+    char type;
+    int32_t size;
+    if ((ret = srs_flv_read_header(flv, header)) != ERROR_SUCCESS 
+        || (ret = srs_flv_read_tag_header(flv, &type, &size, pstarttime)) != ERROR_SUCCESS
+    ) {
+        srs_flv_close(flv);
+        Error("read the first tag of switch flv %s failed. ret=%d", switch_input.c_str(), ret);
+        return ret;
+    }
+    srs_flv_lseek(flv, 0);
+    *pflv = flv;
+    
+    return ret;
+}
+
+// whether the property of onMetaData describes the video, ie. videocodecid.
+static bool metadata_is_video(string key){
+    return key.find("video") == 0 || key == "hasVideo" || key == "width" || key == "height" 
+        || key == "framerate" || key == "hasKeyframes" || key == "keyframes";
+}
+
+// whether the property of onMetaData describes the audio, ie. audiocodecid.
+static bool metadata_is_audio(string key){
+    return key.find("audio") == 0 || key == "hasAudio" || key == "stereo";
+}
+
+int StRtmpPublishClient::RewriteMetadata(char** pdata, int32_t* psize){
+    int ret = ERROR_SUCCESS;
+    
+    // publish as is when not the onMetaData with object.
+    int nparsed = 0;
+    srs_amf0_t onMetaData = srs_amf0_parse(*pdata, *psize, &nparsed);
+    if (!onMetaData) {
+        return ret;
+    }
+    srs_amf0_t metadata = srs_amf0_parse(*pdata + nparsed, *psize - nparsed, &nparsed);
+    if (metadata && srs_amf0_is_ecma_array(metadata)) {
+        srs_amf0_t obj = srs_amf0_ecma_array_to_object(metadata);
+        srs_amf0_free(metadata);
+        metadata = obj;
+    }
+    if (!metadata || !srs_amf0_is_object(metadata)) {
+        srs_amf0_free(onMetaData);
+        srs_amf0_free(metadata);
+        return ret;
+    }
+    
+    // no api to remove property, so copy the others to a new object.
+    if (!audio || !video) {
+        srs_amf0_t filtered = srs_amf0_create_object();
+        for (int i = 0; i < srs_amf0_object_property_count(metadata); i++) {
+            string key = srs_amf0_object_property_name_at(metadata, i);
+            if ((!video && metadata_is_video(key)) || (!audio && metadata_is_audio(key))) {
+                Info("remove metadata %s, audio=%d, video=%d", key.c_str(), audio, video);
+                continue;
+            }
+            
+            // copy the value by serialize then parse.
+            srs_amf0_t value = srs_amf0_object_property_value_at(metadata, i);
+            vector<char> bytes(srs_amf0_size(value));
+            if ((ret = srs_amf0_serialize(value, &bytes[0], (int)bytes.size())) != ERROR_SUCCESS) {
+                break;
+            }
+            srs_amf0_object_property_set(filtered, key.c_str(), srs_amf0_parse(&bytes[0], (int)bytes.size(), NULL));
         }
+        srs_amf0_free(metadata);
+        metadata = filtered;
+    }
+    
+    if (ret == ERROR_SUCCESS && srs_amf0_object_property(metadata, "duration")) {
+        srs_amf0_object_property_set(metadata, "duration", srs_amf0_create_number(-1));
+    }
+    
+    // serialize to bytes.
+    if (ret == ERROR_SUCCESS) {
+        int nb_onMetaData = srs_amf0_size(onMetaData);
+        int nb_metadata = srs_amf0_size(metadata);
+        
+        delete[] *pdata;
+        *psize = nb_onMetaData + nb_metadata;
+        *pdata = new char[*psize];
         
-        if (timestamp - re > 300) {
-            st_usleep((timestamp - re) * 1000);
-            re = timestamp;
+        ret = srs_amf0_serialize(onMetaData, *pdata, nb_onMetaData);
+        if (ret == ERROR_SUCCESS) {
+            ret = srs_amf0_serialize(metadata, *pdata + nb_onMetaData, nb_metadata);
         }
     }
     
+    srs_amf0_free(onMetaData);
+    srs_amf0_free(metadata);
+    
+    if (ret != ERROR_SUCCESS) {
+        Error("rewrite metadata failed. ret=%d", ret);
+        return ret;
+    }
+    
     return ret;
 }
@@ -34,24 +34,126 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 #include <htl_app_rtmp_protocol.hpp>
 
+// the flv source to publish, which can be validated before publish.
+class StFlvSource
+{
+public:
+    /**
+    * scan all tags of flv file, find the first bad tag.
+    * @param truncate whether use the valid tags before the bad tag.
+    * @return an error when file is corrupt and not truncate.
+    * @remark the result is cached, @see GetValidSize.
+    */
+    static int Validate(std::string input, bool truncate);
+    /**
+    * get the bytes of valid tags for publisher.
+    * @return -1 when not validated or the whole file is ok.
+    */
+    static int64_t GetValidSize(std::string input);
+    /**
+    * check whether the flv file has the tags to publish.
+    * @param audio whether to publish the audio tags.
+    * @param video whether to publish the video tags.
+    * @return an error when no tag of the kinds to publish.
+    */
+    static int CheckMedia(std::string input, bool audio, bool video);
+    /**
+    * get the size of the largest tag, for each publisher reads a tag to memory.
+    * @return -1 when open the flv file failed.
+    */
+    static int64_t GetMaxTagSize(std::string input);
+};
+
+/**
+* shape the video to the target bitrate, to model the real camera.
+* when exceed the budget, drop the non-reference frame, or wait before the reference frame.
+* the average is held over a window of 10s, and the achieved bitrate is reported to statistic each second.
+*/
+class StBitrateShaper
+{
+private:
+    // the target video bitrate in kbps, 0 to disable.
+    int target_kbps;
+    // the window to hold the average, in ms.
+    int64_t window_start;
+    int64_t window_bytes;
+    // the second to report the achieved bitrate, in ms.
+    int64_t second_start;
+    int64_t second_bytes;
+    int second_frames;
+    int nb_dropped;
+public:
+    StBitrateShaper();
+    virtual ~StBitrateShaper();
+public:
+    virtual void SetTarget(int kbps);
+    /**
+    * check the video tag before send it.
+    * @param pwait_ms output the ms to wait before send it.
+    * @return true to drop the tag.
+    */
+    virtual bool Shape(char* data, int size, int* pwait_ms);
+    // when the video tag is sent, account the bytes.
+    virtual void OnSent(int size);
+private:
+    // whether the h.264 frame is never referenced, which can be dropped safely.
+    virtual bool IsNonReference(char* data, int size);
+    virtual void Report(int64_t now);
+};
+
 class StRtmpPublishClient
 {
 private:
     srs_rtmp_t srs;
     int stream_id;
+private:
+    // the wallclock and dts when publish the first tag,
+    // to pace the tags by wallclock, never drift for long time.
+    int64_t start_wallclock;
+    int64_t start_dts;
+private:
+    // whether publish the audio and video tags of flv.
+    bool audio;
+    bool video;
+    StBitrateShaper shaper;
+    // switch to another flv after the ms of publish, empty to disable.
+    std::string switch_input;
+    int64_t switch_ms;
+    // whether switched in current publish, only switch once.
+    bool switched;
 public:
     StRtmpPublishClient();
     virtual ~StRtmpPublishClient();
 public:
-    virtual int Publish(std::string input, RtmpUrl* url);
+    /**
+    * publish the flv file to url, loop when EOF.
+    * @param audio whether publish the audio tags, false for video-only stream.
+    * @param video whether publish the video tags, false for audio-only stream.
+    */
+    virtual int Publish(std::string input, RtmpUrl* url, bool audio, bool video);
+    // set the target video bitrate in kbps, 0 to publish as is.
+    virtual void SetBitrate(int kbps);
+    /**
+    * switch to another flv once after the seconds of each publish, ie. with a different
+    * resolution, so the sps/pps changes without republish, and the timestamp continues.
+    */
+    virtual void SetSwitch(std::string input, double seconds);
 private:
     virtual int Connect(RtmpUrl* url);
     virtual int Handshake();
     virtual int ConnectApp();
     virtual int PublishStram();
-    virtual int PublishAV(srs_flv_t flv, 
+    virtual int PublishAV(srs_flv_t flv, int64_t valid_size, 
         int64_t timebase, int32_t* starttime, int32_t* endtime
     );
+    // open the switch flv, get the timestamp of its first tag.
+    virtual int OpenSwitch(srs_flv_t* pflv, u_int32_t* pstarttime);
+    /**
+    * rewrite the onMetaData, set the duration to -1 for live stream,
+    * and remove the properties of disabled kind, ie. the videocodecid for audio-only.
+    * @param pdata the data of script tag, replaced when rewrite.
+    */
+    virtual int RewriteMetadata(char** pdata, int32_t* psize);
 };
 
 #endif
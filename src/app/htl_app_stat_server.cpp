@@ -0,0 +1,479 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+#include <htl_stdinc.hpp>
+
+#include <inttypes.h>
+#include <stdlib.h>
+#include <unistd.h>
+#include <errno.h>
+
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+
+#include <algorithm>
+#include <map>
+#include <string>
+#include <sstream>
+using namespace std;
+
+#include <htl_core_error.hpp>
+#include <htl_core_log.hpp>
+
+#include <htl_app_stat_server.hpp>
+
+#define STAT_REQUEST_BUFFER 4096
+#define STAT_TIMEOUT_US (10 * 1000 * 1000LL)
+// the backoff when accept failed, ie. EMFILE, to yield to other st-threads.
+#define STAT_ACCEPT_MIN_BACKOFF_MS 10
+#define STAT_ACCEPT_MAX_BACKOFF_MS 1000
+
+// the connection to serve.
+struct StStatConnection
+{
+    StStatServer* server;
+    st_netfd_t client;
+};
+
+// escape the label value of prometheus, only the \\, \" and \n are allowed.
+static string label_escape(string str){
+    string escaped;
+    
+    for(size_t i = 0; i < str.length(); i++){
+        char ch = str.at(i);
+        if(ch == '"' || ch == '\\'){
+            escaped += '\\';
+            escaped += ch;
+        } else if(ch == '\n'){
+            escaped += "\\n";
+        } else{
+            escaped += ch;
+        }
+    }
+    
+    return escaped;
+}
+
+StStatServer::StStatServer(){
+    port = 0;
+    stfd = NULL;
+}
+
+StStatServer::~StStatServer(){
+    if(stfd){
+        int fd = st_netfd_fileno(stfd);
+        st_netfd_close(stfd);
+        ::close(fd);
+    }
+}
+
+int StStatServer::Listen(string role, string url, string listen, int argc, char** argv){
+    int ret = ERROR_SUCCESS;
+    
+    this->role = role;
+    this->url = url;
+    
+    for(int i = 0; i < argc; i++){
+        this->argv.push_back(argv[i]);
+    }
+    
+    // parse the ip:port or port.
+    size_t pos = listen.rfind(":");
+    if(pos == string::npos){
+        port = atoi(listen.c_str());
+    } else{
+        ip = listen.substr(0, pos);
+        port = atoi(listen.substr(pos + 1).c_str());
+    }
+    
+    if(port <= 0){
+        ret = ERROR_URL_INVALID;
+        Error("invalid stat listen %s. ret=%d", listen.c_str(), ret);
+        return ret;
+    }
+    
+    int fd = socket(AF_INET, SOCK_STREAM, 0);
+    if(fd == -1){
+        ret = ERROR_SOCKET;
+        Error("create stat socket error. ret=%d", ret);
+        return ret;
+    }
+    
+    int reuse_socket = 1;
+    if(setsockopt(fd, SOL_SOCKET, SO_REUSEADDR, &reuse_socket, sizeof(int)) == -1){
+        ::close(fd);
+        ret = ERROR_SOCKET;
+        Error("setsockopt reuse-addr error. ret=%d", ret);
+        return ret;
+    }
+    
+    sockaddr_in addr;
+    addr.sin_family = AF_INET;
+    addr.sin_port = htons(port);
+    addr.sin_addr.s_addr = ip.empty()? INADDR_ANY : inet_addr(ip.c_str());
+    
+    if(bind(fd, (const sockaddr*)&addr, sizeof(sockaddr_in)) == -1 || ::listen(fd, 512) == -1){
+        ::close(fd);
+        ret = ERROR_SOCKET_LISTEN;
+        Error("listen stat server at %s failed. ret=%d", listen.c_str(), ret);
+        return ret;
+    }
+    
+    if((stfd = st_netfd_open_socket(fd)) == NULL){
+        ::close(fd);
+        ret = ERROR_OPEN_SOCKET;
+        Error("st_netfd_open_socket failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if(st_thread_create(listen_cycle, this, 0, 0) == NULL){
+        ret = ERROR_ST_THREAD_CREATE;
+        Error("create stat server thread failed. ret=%d", ret);
+        return ret;
+    }
+    
+    Trace("stat server listen at %s:%d", ip.empty()? "0.0.0.0":ip.c_str(), port);
+    
+    return ret;
+}
+
+void* StStatServer::listen_cycle(void* args){
+    StStatServer* server = (StStatServer*)args;
+    
+    int backoff_ms = STAT_ACCEPT_MIN_BACKOFF_MS;
+    for(;;){
+        st_netfd_t client = st_accept(server->stfd, NULL, NULL, ST_UTIME_NO_TIMEOUT);
+        if(client == NULL){
+            // the accept fails without io, ie. out of fds, so sleep to never starve the clients.
+            Warn("stat server accept failed, retry in %dms", backoff_ms);
+            st_usleep((st_utime_t)backoff_ms * 1000);
+            backoff_ms = std::min(backoff_ms * 2, STAT_ACCEPT_MAX_BACKOFF_MS);
+            continue;
+        }
+        backoff_ms = STAT_ACCEPT_MIN_BACKOFF_MS;
+        
+        StStatConnection* conn = new StStatConnection();
+        conn->server = server;
+        conn->client = client;
+        
+        if(st_thread_create(serve_cycle, conn, 0, 0) == NULL){
+            Warn("create stat connection thread failed, ignore");
+            
+            int fd = st_netfd_fileno(client);
+            st_netfd_close(client);
+            ::close(fd);
+            delete conn;
+        }
+    }
+    
+    return NULL;
+}
+
+void* StStatServer::serve_cycle(void* args){
+    StStatConnection* conn = (StStatConnection*)args;
+    
+    int ret = conn->server->Serve(conn->client);
+    if(ret != ERROR_SUCCESS){
+        Info("serve stat client failed. ret=%d", ret);
+    }
+    
+    int fd = st_netfd_fileno(conn->client);
+    st_netfd_close(conn->client);
+    ::close(fd);
+    
+    delete conn;
+    
+    return NULL;
+}
+
+int StStatServer::Serve(st_netfd_t client){
+    int ret = ERROR_SUCCESS;
+    
+    // read until the end of header, ignore the body.
+    string request;
+    char buf[STAT_REQUEST_BUFFER];
+    while(request.find("\r\n\r\n") == string::npos){
+        if(request.length() >= STAT_REQUEST_BUFFER){
+            return ERROR_HP_REQUEST_TOO_LARGE;
+        }
+        
+        ssize_t nread = st_read(client, buf, sizeof(buf), STAT_TIMEOUT_US);
+        if(nread <= 0){
+            return ERROR_READ;
+        }
+        request.append(buf, nread);
+    }
+    
+    // GET /path HTTP/1.1
+    string path;
+    size_t start = request.find(" ");
+    if(start != string::npos){
+        size_t end = request.find(" ", start + 1);
+        if(end != string::npos){
+            path = request.substr(start + 1, end - start - 1);
+        }
+    }
+    if((start = path.find("?")) != string::npos){
+        path = path.substr(0, start);
+    }
+    
+    string status = "200 OK";
+    string content_type = "application/json";
+    string body;
+    // st-thread never switch without io, so the body is a consistent snapshot of statistic.
+    if(path == "/" || path == "/api/v1/summary"){
+        body = BuildSummary();
+    } else if(path == "/api/v1/clients"){
+        body = BuildClients();
+    } else if(path == "/metrics"){
+        content_type = "text/plain; version=0.0.4";
+        body = BuildMetrics();
+    } else{
+        status = "404 Not Found";
+        content_type = "text/plain";
+        body = "not found";
+    }
+    
+    stringstream ss;
+    ss << "HTTP/1.1 " << status << "\r\n"
+        << "Server: " << ProductStatServerName << "\r\n"
+        << "Content-Type: " << content_type << "\r\n"
+        << "Content-Length: " << body.length() << "\r\n"
+        << "Connection: close\r\n"
+        << "\r\n"
+        << body;
+    
+    string response = ss.str();
+    if(st_write(client, response.data(), response.length(), STAT_TIMEOUT_US) != (ssize_t)response.length()){
+        return ERROR_SEND;
+    }
+    
+    return ret;
+}
+
+string StStatServer::BuildSummary(){
+    stringstream ss;
+    
+    int video_clients = 0; int64_t video_kbps = 0, video_fps = 0;
+    statistic->GetVideoQuality(&video_clients, &video_kbps, &video_fps);
+    
+    ss << "{"
+        << "\"code\":0,"
+        << "\"pid\":" << getpid() << ","
+        << "\"version\":\"" << ProductVersion << "\","
+        << "\"argv\":[";
+    for(size_t i = 0; i < argv.size(); i++){
+        ss << (i > 0? ",":"") << "\"" << json_escape(argv.at(i)) << "\"";
+    }
+    ss << "],"
+        << "\"seed\":" << StUtility::GetRandomSeed() << ","
+        << "\"duration\":" << statistic->GetDuration() << ","
+        << "\"threads\":" << statistic->GetThreads() << ","
+        << "\"alive\":" << statistic->GetAlive() << ","
+        << "\"nread\":" << statistic->GetReadBytes() << ","
+        << "\"nwrite\":" << statistic->GetWriteBytes() << ","
+        << "\"tasks\":" << statistic->GetTasks() << ","
+        << "\"err_tasks\":" << statistic->GetErrorTasks() << ","
+        << "\"sub_tasks\":" << statistic->GetSubTasks() << ","
+        << "\"err_sub_tasks\":" << statistic->GetErrorSubTasks() << ","
+        << "\"task_duration\":" << statistic->GetTaskDuration() << ","
+        << "\"setup\":" << BuildPercentiles(statistic->GetSetup()) << ","
+        << "\"first_audio\":" << BuildPercentiles(statistic->GetFirstAudio()) << ","
+        << "\"first_video\":" << BuildPercentiles(statistic->GetFirstVideo()) << ","
+        << "\"video\":{\"clients\":" << video_clients << ",\"kbps\":" << video_kbps << ",\"fps\":" << video_fps << "},"
+        << "\"freezes\":" << statistic->GetFreezes() << ","
+        << "\"max_freeze\":" << statistic->GetMaxFreeze() << ","
+        << "\"sequence_changes\":" << statistic->GetSequenceChanges() << ","
+        << "\"max_sequence_gap\":" << statistic->GetMaxSequenceGap() << ","
+        << "\"segment\":" << BuildPercentiles(statistic->GetSegment()) << ","
+        << "\"segment_bytes\":" << statistic->GetSegmentBytes() << ","
+        << "\"stales\":" << statistic->GetStales() << ","
+        << "\"complete_frames\":" << statistic->GetCompleteFrames() << ","
+        << "\"incomplete_frames\":" << statistic->GetIncompleteFrames() << ","
+        << "\"valid_streams\":" << statistic->GetValidStreams() << ","
+        << "\"invalid_streams\":" << statistic->GetInvalidStreams()
+        << "}";
+    
+    return ss.str();
+}
+
+string StStatServer::BuildPercentiles(StSamples* samples){
+    stringstream ss;
+    
+    ss << "{"
+        << "\"count\":" << samples->GetCount() << ","
+        << "\"p50\":" << samples->GetPercentile(0.5) << ","
+        << "\"p95\":" << samples->GetPercentile(0.95) << ","
+        << "\"p99\":" << samples->GetPercentile(0.99)
+        << "}";
+    
+    return ss.str();
+}
+
+string StStatServer::BuildClients(){
+    stringstream ss;
+    
+    ss << "{\"code\":0,\"clients\":[";
+    
+    std::map<int, StClientStatistic>& clients = statistic->GetClients();
+    for(std::map<int, StClientStatistic>::iterator it = clients.begin(); it != clients.end(); ++it){
+        StClientStatistic& client = it->second;
+        ss << (it != clients.begin()? ",":"") << "{"
+            << "\"id\":" << client.tid << ","
+            << "\"url\":\"" << json_escape(client.url) << "\","
+            << "\"alive\":" << (client.alive? "true":"false") << ","
+            << "\"nread\":" << client.nread << ","
+            << "\"nwrite\":" << client.nwrite << ","
+            << "\"tasks\":" << client.tasks << ","
+            << "\"err_tasks\":" << client.err_tasks << ","
+            << "\"sub_tasks\":" << client.sub_tasks << ","
+            << "\"err_sub_tasks\":" << client.err_sub_tasks << ","
+            << "\"first_audio\":" << client.first_audio << ","
+            << "\"first_video\":" << client.first_video << ","
+            << "\"reconnects\":" << client.reconnects << ","
+            << "\"video_kbps\":" << client.video_kbps << ","
+            << "\"video_fps\":" << client.video_fps << ","
+            << "\"freezes\":" << client.freezes << ","
+            << "\"max_freeze\":" << client.max_freeze << ","
+            << "\"sequence_changes\":" << client.sequence_changes
+            << "}";
+    }
+    
+    ss << "]}";
+    
+    return ss.str();
+}
+
+string StStatServer::BuildMetrics(){
+    stringstream ss;
+    
+    string label = "role=\"" + label_escape(role) + "\"";
+    
+    ss << "# HELP srs_bench_uptime_seconds The running time of load test.\n"
+        << "# TYPE srs_bench_uptime_seconds gauge\n"
+        << "srs_bench_uptime_seconds{" << label << "} " << statistic->GetDuration() / 1000.0 << "\n";
+    
+    ss << "# HELP srs_bench_clients The number of client threads.\n"
+        << "# TYPE srs_bench_clients gauge\n"
+        << "srs_bench_clients{" << label << "} " << statistic->GetThreads() << "\n";
+    
+    // the active clients, labeled by the url template, for the url of client maybe random.
+    int active = 0;
+    std::map<int, StClientStatistic>& clients = statistic->GetClients();
+    for(std::map<int, StClientStatistic>::iterator it = clients.begin(); it != clients.end(); ++it){
+        active += it->second.alive? 1:0;
+    }
+    ss << "# HELP srs_bench_clients_active The number of clients which is working on a task.\n"
+        << "# TYPE srs_bench_clients_active gauge\n"
+        << "srs_bench_clients_active{" << label << ",stream=\"" << label_escape(url) << "\"} " << active << "\n";
+    
+    ss << "# HELP srs_bench_bytes_received_total The bytes received from server.\n"
+        << "# TYPE srs_bench_bytes_received_total counter\n"
+        << "srs_bench_bytes_received_total{" << label << "} " << statistic->GetReadBytes() << "\n";
+    
+    ss << "# HELP srs_bench_bytes_sent_total The bytes sent to server.\n"
+        << "# TYPE srs_bench_bytes_sent_total counter\n"
+        << "srs_bench_bytes_sent_total{" << label << "} " << statistic->GetWriteBytes() << "\n";
+    
+    ss << "# HELP srs_bench_tasks_total The tasks started, ie. the connections to server.\n"
+        << "# TYPE srs_bench_tasks_total counter\n"
+        << "srs_bench_tasks_total{" << label << "} " << statistic->GetTasks() << "\n";
+    
+    ss << "# HELP srs_bench_task_errors_total The tasks failed.\n"
+        << "# TYPE srs_bench_task_errors_total counter\n"
+        << "srs_bench_task_errors_total{" << label << "} " << statistic->GetErrorTasks() << "\n";
+    
+    ss << "# HELP srs_bench_sub_tasks_total The sub tasks started, ie. the ts of HLS.\n"
+        << "# TYPE srs_bench_sub_tasks_total counter\n"
+        << "srs_bench_sub_tasks_total{" << label << "} " << statistic->GetSubTasks() << "\n";
+    
+    ss << "# HELP srs_bench_sub_task_errors_total The sub tasks failed.\n"
+        << "# TYPE srs_bench_sub_task_errors_total counter\n"
+        << "srs_bench_sub_task_errors_total{" << label << "} " << statistic->GetErrorSubTasks() << "\n";
+    
+    int video_clients = 0; int64_t video_kbps = 0, video_fps = 0;
+    statistic->GetVideoQuality(&video_clients, &video_kbps, &video_fps);
+    ss << "# HELP srs_bench_video_kbps The average video bitrate of clients in last second.\n"
+        << "# TYPE srs_bench_video_kbps gauge\n"
+        << "srs_bench_video_kbps{" << label << "} " << video_kbps << "\n";
+    
+    ss << "# HELP srs_bench_video_fps The average video fps of clients in last second.\n"
+        << "# TYPE srs_bench_video_fps gauge\n"
+        << "srs_bench_video_fps{" << label << "} " << video_fps << "\n";
+    
+    ss << "# HELP srs_bench_video_freezes_total The times video freezed of players.\n"
+        << "# TYPE srs_bench_video_freezes_total counter\n"
+        << "srs_bench_video_freezes_total{" << label << "} " << statistic->GetFreezes() << "\n";
+    
+    ss << "# HELP srs_bench_video_max_freeze_seconds The max duration of video freeze of players.\n"
+        << "# TYPE srs_bench_video_max_freeze_seconds gauge\n"
+        << "srs_bench_video_max_freeze_seconds{" << label << "} " << statistic->GetMaxFreeze() / 1000.0 << "\n";
+    
+    ss << "# HELP srs_bench_h264_sequence_changes_total The times h.264 sps/pps changed of players.\n"
+        << "# TYPE srs_bench_h264_sequence_changes_total counter\n"
+        << "srs_bench_h264_sequence_changes_total{" << label << "} " << statistic->GetSequenceChanges() << "\n";
+    
+    ss << "# HELP srs_bench_h264_max_sequence_gap_seconds The max gap of video around the h.264 sps/pps change of players.\n"
+        << "# TYPE srs_bench_h264_max_sequence_gap_seconds gauge\n"
+        << "srs_bench_h264_max_sequence_gap_seconds{" << label << "} " << statistic->GetMaxSequenceGap() / 1000.0 << "\n";
+    
+    ss << "# HELP srs_bench_h264_complete_frames_total The validated h.264 frames of players, all NALUs are complete.\n"
+        << "# TYPE srs_bench_h264_complete_frames_total counter\n"
+        << "srs_bench_h264_complete_frames_total{" << label << "} " << statistic->GetCompleteFrames() << "\n";
+    
+    ss << "# HELP srs_bench_h264_incomplete_frames_total The validated h.264 frames of players, some NALUs are truncated.\n"
+        << "# TYPE srs_bench_h264_incomplete_frames_total counter\n"
+        << "srs_bench_h264_incomplete_frames_total{" << label << "} " << statistic->GetIncompleteFrames() << "\n";
+    
+    ss << "# HELP srs_bench_h264_invalid_streams_total The validated h.264 streams of players, undecodable when play done.\n"
+        << "# TYPE srs_bench_h264_invalid_streams_total counter\n"
+        << "srs_bench_h264_invalid_streams_total{" << label << "} " << statistic->GetInvalidStreams() << "\n";
+    
+    ss << "# HELP srs_bench_hls_segment_bytes_total The bytes of segments downloaded by HLS clients.\n"
+        << "# TYPE srs_bench_hls_segment_bytes_total counter\n"
+        << "srs_bench_hls_segment_bytes_total{" << label << "} " << statistic->GetSegmentBytes() << "\n";
+    
+    ss << "# HELP srs_bench_hls_stales_total The times the live playlist of HLS is stale.\n"
+        << "# TYPE srs_bench_hls_stales_total counter\n"
+        << "srs_bench_hls_stales_total{" << label << "} " << statistic->GetStales() << "\n";
+    
+    // the histogram in seconds.
+    StHistogram* first_packet = statistic->GetFirstPacket();
+    ss << "# HELP srs_bench_first_packet_seconds The time from connect to the first packet of players.\n"
+        << "# TYPE srs_bench_first_packet_seconds histogram\n";
+    for(int i = 0; i < StHistogramBuckets; i++){
+        int64_t bound = StHistogram::GetBound(i);
+        ss << "srs_bench_first_packet_seconds_bucket{" << label << ",le=\"";
+        if(bound < 0){
+            ss << "+Inf";
+        } else{
+            ss << bound / 1000.0;
+        }
+        ss << "\"} " << first_packet->GetBucket(i) << "\n";
+    }
+    ss << "srs_bench_first_packet_seconds_sum{" << label << "} " << first_packet->GetSum() / 1000.0 << "\n"
+        << "srs_bench_first_packet_seconds_count{" << label << "} " << first_packet->GetCount() << "\n";
+    
+    return ss.str();
+}
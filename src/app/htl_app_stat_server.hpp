@@ -0,0 +1,69 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+#ifndef _htl_app_stat_server_hpp
+#define _htl_app_stat_server_hpp
+
+/*
+#include <htl_app_stat_server.hpp>
+*/
+#include <string>
+#include <vector>
+
+#include <htl_os_st.hpp>
+
+// the http server to query the statistic when load test is running.
+class StStatServer
+{
+private:
+    std::string ip;
+    int port;
+    st_netfd_t stfd;
+    // the role of load test, ie. play or publish.
+    std::string role;
+    // the url template of clients, ie. the {i} is not replaced.
+    std::string url;
+    // the command line of load test.
+    std::vector<std::string> argv;
+public:
+    StStatServer();
+    virtual ~StStatServer();
+public:
+    /**
+    * listen at the endpoint and serve in a st-thread.
+    * @param role the role of load test, the label of metrics, ie. play or publish.
+    * @param url the url template of clients, the stream label of metrics.
+    * @param listen the endpoint, ie. :6060 or 127.0.0.1:6060
+    */
+    virtual int Listen(std::string role, std::string url, std::string listen, int argc, char** argv);
+private:
+    static void* listen_cycle(void* args);
+    static void* serve_cycle(void* args);
+    virtual int Serve(st_netfd_t client);
+    virtual std::string BuildSummary();
+    virtual std::string BuildPercentiles(StSamples* samples);
+    virtual std::string BuildClients();
+    virtual std::string BuildMetrics();
+};
+
+#endif
@@ -26,6 +26,7 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 #include <inttypes.h>
 #include <stdlib.h>
 
+#include <algorithm>
 #include <string>
 #include <sstream>
 using namespace std;
@@ -37,6 +38,10 @@ using namespace std;
 #include <htl_app_task_base.hpp>
 
 StBaseTask::StBaseTask(){
+    backoff_seconds = 0;
+    nb_errors = 0;
+    last_error_time = 0;
+    reconnecting = false;
 }
 
 StBaseTask::~StBaseTask(){
@@ -56,22 +61,82 @@ int StBaseTask::InitializeBase(std::string http_url, double startup, double dela
     this->error_seconds = error;
     this->count = count;
     
+    startup_seed = StUtility::BuildRandomSeed(GetId(), "startup");
+    delay_seed = StUtility::BuildRandomSeed(GetId(), "delay");
+    backoff_seed = StUtility::BuildRandomSeed(GetId(), "backoff");
+    
     return ret;
 }
 
+void StBaseTask::SetBackoff(double backoff){
+    backoff_seconds = backoff;
+}
+
 int StBaseTask::Process(){
     int ret = ERROR_SUCCESS;
     
     if(startup_seconds > 0){
-        int sleep_ms = StUtility::BuildRandomMTime(startup_seconds);
+        int sleep_ms = StUtility::BuildRandomMTime(startup_seconds, &startup_seed);
         Trace("start random sleep %dms", sleep_ms);
         st_usleep(sleep_ms * 1000);
     }
     
     if((ret = ProcessTask()) != ERROR_SUCCESS){
+        // the task is interrupted when quit, it's ok.
+        if(StFarm::IsQuit()){
+            return ERROR_SUCCESS;
+        }
         return ret;
     }
     
     return ret;
 }
 
+bool StBaseTask::ShouldRun(int index){
+    if(StFarm::IsQuit()){
+        return false;
+    }
+    
+    // if count is zero, infinity loop.
+    if(count != 0 && index >= count){
+        return false;
+    }
+    
+    // only the error which really reconnect, not the last one or interrupted by quit.
+    if(reconnecting){
+        reconnecting = false;
+        statistic->OnReconnect(GetId());
+    }
+    
+    return true;
+}
+
+int StBaseTask::BuildErrorMTime(){
+    reconnecting = true;
+    
+    if(backoff_seconds <= 0){
+        return (int)(error_seconds * 1000);
+    }
+    
+    // reset the backoff when no error for a while, for the client has recovered.
+    int64_t now = StUtility::GetCurrentTime();
+    if(last_error_time > 0 && now - last_error_time > backoff_seconds * 2 * 1000){
+        nb_errors = 0;
+    }
+    last_error_time = now;
+    
+    double sleep_seconds = std::max(error_seconds, (double)StBackoffMinSeconds);
+    for(int i = 0; i < nb_errors && sleep_seconds < backoff_seconds; i++){
+        sleep_seconds *= 2;
+    }
+    nb_errors++;
+    
+    int sleep_ms = StUtility::BuildRandomMTime(sleep_seconds, &backoff_seed);
+    if(sleep_ms > backoff_seconds * 1000){
+        sleep_ms = (int)(backoff_seconds * 1000);
+    }
+    
+    Info("backoff %d errors, sleep %dms", nb_errors, sleep_ms);
+    return sleep_ms;
+}
+
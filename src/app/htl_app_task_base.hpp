@@ -34,6 +34,9 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 #include <htl_os_st.hpp>
 
+// the min seconds to start the exponential backoff, for the error seconds maybe 0.
+#define StBackoffMinSeconds 0.1
+
 class StBaseTask : public StTask
 {
 protected:
@@ -41,16 +44,40 @@ protected:
     double delay_seconds;
     double error_seconds;
     int count;
+protected:
+    // the max seconds of exponential backoff when error, 0 to disable.
+    double backoff_seconds;
+    // the continuous errors, and the last time in ms of error.
+    int nb_errors;
+    int64_t last_error_time;
+    // whether the last loop failed, to stat the reconnect when run again.
+    bool reconnecting;
+protected:
+    // the random seeds derived from the master seed.
+    unsigned int startup_seed;
+    unsigned int delay_seed;
+    unsigned int backoff_seed;
 public:
     StBaseTask();
     virtual ~StBaseTask();
 protected:
     virtual int InitializeBase(std::string http_url, double startup, double delay, double error, int count);
 public:
+    /**
+    * enable the exponential backoff when error, which start from error seconds at least
+    * StBackoffMinSeconds, double for each continuous error with jitter, and never exceed the backoff.
+    * @param backoff the max seconds to sleep when error, 0 to always sleep error seconds.
+    */
+    virtual void SetBackoff(double backoff);
     virtual int Process();
 protected:
     virtual Uri* GetUri() = 0;
     virtual int ProcessTask() = 0;
+    // whether to run the loop of index, for the repeat count and quit.
+    // stat the reconnect when run again after error.
+    virtual bool ShouldRun(int index);
+    // build the sleep time in ms when error, then reconnect.
+    virtual int BuildErrorMTime();
 };
 
 #endif
@@ -37,36 +37,65 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 #define ERROR_READ 104
 #define ERROR_CLOSE 105
 #define ERROR_DNS_RESOLVE 106
+#define ERROR_SOCKET_LISTEN 107
+#define ERROR_SOCKET_TIMEOUT 108
 
 #define ERROR_URL_INVALID 200
 #define ERROR_HTTP_RESPONSE 201
 #define ERROR_HLS_INVALID 202
+// the http status 5xx or 429, the server is busy, retry it.
+#define ERROR_HTTP_STATUS_RETRY 203
+// the http status 4xx except 429, the request is wrong, never retry.
+#define ERROR_HTTP_STATUS_FATAL 204
+#define ERROR_HTTP_FLV_HEADER 205
+#define ERROR_HTTP_FLV_TAG 206
+#define ERROR_HTTP_FLV_EOF 207
 
 #define ERROR_NOT_SUPPORT 300
 
 #define ERROR_ST_INITIALIZE 400
 #define ERROR_ST_THREAD_CREATE 401
+#define ERROR_ST_RLIMIT 402
+#define ERROR_ST_OPEN_REPORT 403
 
 #define ERROR_HP_PARSE_URL 500
 #define ERROR_HP_EP_CHNAGED 501
 #define ERROR_HP_PARSE_RESPONSE 502
+#define ERROR_HP_REQUEST_TOO_LARGE 503
 
 #define ERROR_RTMP_URL 600
 #define ERROR_RTMP_OVERFLOW 601
 #define ERROR_RTMP_MSG_TOO_BIG 602
 #define ERROR_RTMP_INVALID_RESPONSE 603
 #define ERROR_RTMP_OPEN_FLV 604
+#define ERROR_RTMP_FLV_INVALID 605
+#define ERROR_RTMP_FLV_EOF 606
+#define ERROR_RTMP_DUMP_VIDEO 607
+#define ERROR_RTMP_H264_FORBIDDEN_BIT 608
+#define ERROR_RTMP_H264_NALU_TYPE 609
+#define ERROR_RTMP_H264_NO_SEQUENCE 610
+#define ERROR_RTMP_H264_NO_FRAME 611
+#define ERROR_RTMP_FLV_NO_MEDIA 612
+#define ERROR_RTMP_H264_SEQUENCE 613
+#define ERROR_RTMP_FLV_SWITCH 614
 
 #define ProductVersion "1.0.14"
 #define ProductHTTPName "SB(SRS Bench) HttpLoad/"ProductVersion
 #define ProductHLSName "SB(SRS Bench) HlsLoad/"ProductVersion
 #define ProductRtmpName "SB(SRS Bench) RtmpPlayLoad/"ProductVersion
+#define ProductHttpFlvName "SB(SRS Bench) HttpFlvLoad/"ProductVersion
 #define ProductRtmpPublishName "SB(SRS Bench) RtmpPublishLoad/"ProductVersion
+#define ProductStatServerName "SB(SRS Bench) StatServer/"ProductVersion
 #define BuildPlatform "linux"
 #define BugReportEmail "winlin@vip.126.com"
 
 #define HTTP_HEADER_BUFFER 1024
 #define HTTP_BODY_BUFFER 32*1024
+#define HTTP_ERROR_MESSAGE_MAX 256
+// the max size of flv tag, to reject the corrupt stream.
+#define HTTP_FLV_MAX_TAG 4*1024*1024
+// the max ms without any data of flv stream, then reconnect it.
+#define HTTP_FLV_STALL_MS 30000
 
 #endif
 
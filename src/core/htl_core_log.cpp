@@ -24,8 +24,12 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 #include <htl_stdinc.hpp>
 
 #include <string.h>
+#include <stdarg.h>
 #include <sys/time.h>
 
+#include <string>
+using namespace std;
+
 #include <htl_core_log.hpp>
 
 DateTime::DateTime(){
@@ -56,7 +60,31 @@ const char* DateTime::FormatTime(){
     return time_data;
 }
 
+// the max size of a log line.
+#define LOG_MAX_SIZE 4096
+
+string json_escape(string str){
+    string escaped;
+    
+    for(size_t i = 0; i < str.length(); i++){
+        char ch = str.at(i);
+        if(ch == '"' || ch == '\\'){
+            escaped += '\\';
+            escaped += ch;
+        } else if((unsigned char)ch < 0x20){
+            char buf[8];
+            snprintf(buf, sizeof(buf), "\\u%04x", (unsigned char)ch);
+            escaped += buf;
+        } else{
+            escaped += ch;
+        }
+    }
+    
+    return escaped;
+}
+
 LogContext::LogContext(){
+    json = false;
 }
 
 LogContext::~LogContext(){
@@ -66,7 +94,49 @@ int LogContext::GetId(){
     return 0;
 }
 
+string LogContext::GetStream(){
+    return "";
+}
+
 const char* LogContext::FormatTime(){
     return time.FormatTime();
 }
 
+void LogContext::SetJson(bool json){
+    this->json = json;
+}
+
+void LogContext::Log(const char* level, const char* event, bool show_errno, const char* fmt, ...){
+    // the errno maybe changed by the log.
+    int err = errno;
+    
+    char msg[LOG_MAX_SIZE];
+    va_list ap;
+    va_start(ap, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, ap);
+    va_end(ap);
+    
+    if(!json){
+        printf("[%s][%d][%s] %s", FormatTime(), GetId(), level, msg);
+        if(show_errno){
+            printf(" errno=%d(%s)", err, strerror(err));
+        }
+        printf("\n");
+        return;
+    }
+    
+    printf("{\"ts\":\"%s\",\"level\":\"%s\",\"id\":%d", FormatTime(), level, GetId());
+    
+    string stream = GetStream();
+    if(!stream.empty()){
+        printf(",\"stream\":\"%s\"", json_escape(stream).c_str());
+    }
+    if(event){
+        printf(",\"event\":\"%s\"", event);
+    }
+    printf(",\"msg\":\"%s\"", json_escape(msg).c_str());
+    if(show_errno){
+        printf(",\"errno\":%d,\"error\":\"%s\"", err, json_escape(strerror(err)).c_str());
+    }
+    printf("}\n");
+}
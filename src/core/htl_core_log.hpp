@@ -52,25 +52,41 @@ class LogContext
 {
 private:
     DateTime time;
+    // whether write log in json lines.
+    bool json;
 public:
     LogContext();
     virtual ~LogContext();
 public:
     virtual void SetId(int id) = 0;
     virtual int GetId();
+    // get the stream of current client, empty if unknown.
+    virtual std::string GetStream();
 public:
     virtual const char* FormatTime();
+    virtual void SetJson(bool json);
+    /**
+    * write a line of log, in text or json.
+    * @param event the lifecycle event, NULL for normal log.
+    * @param show_errno whether append the errno.
+    * @remark the fmt is checked by compiler, where the implicit this is the 1st argument.
+    */
+    virtual void Log(const char* level, const char* event, bool show_errno, const char* fmt, ...)
+        __attribute__((format(printf, 5, 6)));
 };
 
+// escape the string for json, the log in json and the stat server.
+extern std::string json_escape(std::string str);
+
 // user must implements the LogContext and define a global instance.
 extern LogContext* context;
 
 #if 1
-    #define Verbose(msg, ...) printf("[%s][%d][verbs] ", context->FormatTime(), context->GetId());printf(msg, ##__VA_ARGS__);printf("\n")
-    #define Info(msg, ...)    printf("[%s][%d][infos] ", context->FormatTime(), context->GetId());printf(msg, ##__VA_ARGS__);printf("\n")
-    #define Trace(msg, ...)   printf("[%s][%d][trace] ", context->FormatTime(), context->GetId());printf(msg, ##__VA_ARGS__);printf("\n")
-    #define Warn(msg, ...)    printf("[%s][%d][warns] ", context->FormatTime(), context->GetId());printf(msg, ##__VA_ARGS__);printf(" errno=%d(%s)", errno, strerror(errno));printf("\n")
-    #define Error(msg, ...)   printf("[%s][%d][error] ", context->FormatTime(), context->GetId());printf(msg, ##__VA_ARGS__);printf(" errno=%d(%s)", errno, strerror(errno));printf("\n")
+    #define Verbose(msg, ...) context->Log("verbs", NULL, false, msg, ##__VA_ARGS__)
+    #define Info(msg, ...)    context->Log("infos", NULL, false, msg, ##__VA_ARGS__)
+    #define Trace(msg, ...)   context->Log("trace", NULL, false, msg, ##__VA_ARGS__)
+    #define Warn(msg, ...)    context->Log("warns", NULL, true, msg, ##__VA_ARGS__)
+    #define Error(msg, ...)   context->Log("error", NULL, true, msg, ##__VA_ARGS__)
 #else
     #define Verbose(msg, ...) printf("[%s][%d][verbs][%s] ", context->FormatTime(), context->GetId(), __FUNCTION__);printf(msg, ##__VA_ARGS__);printf("\n")
     #define Info(msg, ...)    printf("[%s][%d][infos][%s] ", context->FormatTime(), context->GetId(), __FUNCTION__);printf(msg, ##__VA_ARGS__);printf("\n")
@@ -79,6 +95,9 @@ extern LogContext* context;
     #define Error(msg, ...)   printf("[%s][%d][error][%s] ", context->FormatTime(), context->GetId(), __FUNCTION__);printf(msg, ##__VA_ARGS__);printf(" errno=%d(%s)", errno, strerror(errno));printf("\n")
 #endif
 
+// the lifecycle event, ie. start, startup, quit, which is a trace log.
+#define Event(event, msg, ...) context->Log("trace", event, false, msg, ##__VA_ARGS__)
+
 #if 1
     #undef Verbose
     #define Verbose(msg, ...) (void)0
@@ -33,32 +33,39 @@ using namespace std;
 #include <htl_core_log.hpp>
 #include <htl_core_error.hpp>
 #include <htl_app_hls_load.hpp>
+#include <htl_app_stat_server.hpp>
 
 #include <htl_main_utility.hpp>
 
 #define DefaultDelaySeconds -1
 #define DefaultHttpUrl "http://127.0.0.1:3080/hls/hls.m3u8"
 #define DefaultVod false
+#define DefaultVariant 0
 
 int discovery_options(int argc, char** argv, 
     bool& show_help, bool& show_version, string& url, bool& vod, int& threads, 
-    double& startup, double& delay, double& error, double& report, int& count)
+    double& startup, double& delay, double& error, double& report, int& count, bool& force, unsigned int& seed, string& stat_listen, double& duration, double& backoff, double& grace, string& report_file,
+    int& variant)
 {
     int ret = ERROR_SUCCESS;
     
     static option long_options[] = {
         SharedOptions()
         {"vod", no_argument, 0, 'o'},
+        {"variant", required_argument, 0, 'V'},
         {0, 0, 0, 0}
     };
     
     int opt = 0;
     int option_index = 0;
-    while((opt = getopt_long(argc, argv, "hvc:r:t:os:d:e:m:", long_options, &option_index)) != -1){
+    while((opt = getopt_long(argc, argv, "hvfjS:l:D:b:g:R:c:r:t:os:d:e:m:V:", long_options, &option_index)) != -1){
         switch(opt){
             case 'o':
                 vod = true;
                 break;
+            case 'V':
+                variant = atoi(optarg);
+                break;
             ProcessSharedOptions()
             default:
                 show_help = true;
@@ -71,6 +78,12 @@ int discovery_options(int argc, char** argv,
         show_help = true;
         return ret;
     }
+    
+    if(variant < 0){
+        ret = ERROR_NOT_SUPPORT;
+        Error("the variant index must not be negative, variant=%d. ret=%d", variant, ret);
+        return ret;
+    }
 
     return ret;
 }
@@ -84,6 +97,8 @@ void help(char** argv){
         "Options:\n"
         ShowHelpPart1()
         "  -o, --vod                        Whether url is vod, loop the m3u8 file list. default is %s\n"
+        "  -V INDEX, --variant INDEX        The index of variant to play for master playlist, the last one\n"
+        "                                   if out of range. default: %d\n"
         ShowHelpPart2()
         "\n"
         "\n"
@@ -103,9 +118,9 @@ void help(char** argv){
         "Report bugs to <%s>\n",
         argv[0], argv[0], 
         DefaultThread, DefaultHttpUrl, DefaultCount, // part1
-        (DefaultVod? "true":"false"), // vod
+        (DefaultVod? "true":"false"), DefaultVariant, // vod
         (double)DefaultStartupSeconds, (double)DefaultDelaySeconds, // part2
-        DefaultErrorSeconds, DefaultReportSeconds, // part2
+        DefaultErrorSeconds, DefaultReportSeconds, DefaultGraceSeconds, // part2
         argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl,
         argv[0], DefaultHttpUrl,
         BuildPlatform, BugReportEmail);
@@ -119,9 +134,12 @@ int main(int argc, char** argv){
     bool show_help = false, show_version = false; 
     string url; bool vod = DefaultVod; int threads = DefaultThread; 
     double start = DefaultStartupSeconds, delay = DefaultDelaySeconds, error = DefaultErrorSeconds; 
-    double report = DefaultReportSeconds; int count = DefaultCount;
+    double report = DefaultReportSeconds; int count = DefaultCount; bool force = false; unsigned int seed = 0;
+    string stat_listen; double duration = 0, backoff = 0; double grace = DefaultGraceSeconds; string report_file;
+    int variant = DefaultVariant;
     
-    if((ret = discovery_options(argc, argv, show_help, show_version, url, vod, threads, start, delay, error, report, count)) != ERROR_SUCCESS){
+    if((ret = discovery_options(argc, argv, show_help, show_version, url, vod, threads, start, delay, error, report, count, force, seed, stat_listen, duration, backoff, grace, report_file,
+        variant)) != ERROR_SUCCESS){
         Error("discovery options failed. ret=%d", ret);
         return ret;
     }
@@ -137,26 +155,43 @@ int main(int argc, char** argv){
     
     StFarm farm;
     
-    if((ret = farm.Initialize(report)) != ERROR_SUCCESS){
+    if((ret = farm.Initialize(report, seed)) != ERROR_SUCCESS){
         Error("initialize the farm failed. ret=%d", ret);
         return ret;
     }
+    
+    if((ret = farm.CheckLimits(threads, force)) != ERROR_SUCCESS){
+        Error("check the resource limits failed. ret=%d", ret);
+        return ret;
+    }
+    
+    StStatServer stat_server;
+    if(!stat_listen.empty() && (ret = stat_server.Listen("hls", url, stat_listen, argc, argv)) != ERROR_SUCCESS){
+        Error("start the stat server failed. ret=%d", ret);
+        return ret;
+    }
 
     for(int i = 0; i < threads; i++){
         StHlsTask* task = new StHlsTask();
-
-        if((ret = task->Initialize(url, vod, start, delay, error, count)) != ERROR_SUCCESS){
-            Error("initialize task failed, url=%s, ret=%d", url.c_str(), ret);
+        
+        std::string task_url = build_url(url, i);
+        if((ret = task->Initialize(task_url, vod, start, delay, error, count, variant)) != ERROR_SUCCESS){
+            Error("initialize task failed, url=%s, ret=%d", task_url.c_str(), ret);
             return ret;
         }
         
+        task->SetBackoff(backoff);
+        
         if((ret = farm.Spawn(task)) != ERROR_SUCCESS){
             Error("st farm spwan task failed, ret=%d", ret);
             return ret;
         }
     }
     
-    farm.WaitAll();
+    if((ret = farm.WaitAll(duration, grace, report_file)) != ERROR_SUCCESS){
+        Error("wait all tasks failed. ret=%d", ret);
+        return ret;
+    }
     
     return 0;
 }
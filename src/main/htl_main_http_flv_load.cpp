@@ -0,0 +1,182 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+#include <htl_stdinc.hpp>
+
+#include <getopt.h>
+#include <stdlib.h>
+
+#include <string>
+using namespace std;
+
+// project lib
+#include <htl_core_log.hpp>
+#include <htl_core_error.hpp>
+#include <htl_app_http_flv_load.hpp>
+#include <htl_app_stat_server.hpp>
+
+#include <htl_main_utility.hpp>
+
+#define DefaultDelaySeconds 1.0
+#define DefaultFreezeMs 1000
+#define DefaultHttpUrl "http://127.0.0.1:8080/live/livestream.flv"
+
+int discovery_options(int argc, char** argv, 
+    bool& show_help, bool& show_version, string& url, int& threads, 
+    double& startup, double& delay, double& error, double& report, int& count, bool& force, unsigned int& seed, string& stat_listen, double& duration, double& backoff, double& grace, string& report_file,
+    int& freeze_ms
+){
+    int ret = ERROR_SUCCESS;
+    
+    static option long_options[] = {
+        SharedOptions()
+        {"freeze", required_argument, 0, 'F'},
+        {0, 0, 0, 0}
+    };
+    
+    int opt = 0;
+    int option_index = 0;
+    while((opt = getopt_long(argc, argv, "hvfjS:l:D:b:g:R:c:r:t:s:d:e:m:F:", long_options, &option_index)) != -1){
+        switch(opt){
+            ProcessSharedOptions()
+            case 'F':
+                freeze_ms = atoi(optarg);
+                break;
+            default:
+                show_help = true;
+                break;
+        }
+    }
+    
+    // check values
+    if(url == ""){
+        show_help = true;
+        return ret;
+    }
+
+    return ret;
+}
+
+void help(char** argv){
+    printf("%s, Copyright (c) 2013-2015 winlin\n", ProductHttpFlvName);
+    
+    printf(""
+        "Usage: %s <Options> <-u URL>\n"
+        "%s base on st(state-threads), support huge concurrency.\n"
+        "Options:\n"
+        ShowHelpPart1()
+        "  -F MS, --freeze MS               The video freeze when no new video timestamp for MS ms.\n"
+        "                                   default: %d. 0 means never detect the freeze.\n"
+        ShowHelpPart2()
+        "\n"
+        "Examples:\n"
+        "1. start a client\n"
+        "   %s -c 1 -r %s\n"
+        "2. start 1000 clients\n"
+        "   %s -c 1000 -r %s\n"
+        "3. start 10000 clients\n"
+        "   %s -c 10000 -r %s\n"
+        "4. start 100000 clients\n"
+        "   %s -c 100000 -r %s\n"
+        "\n"
+        "This program built for %s.\n"
+        "Report bugs to <%s>\n",
+        argv[0], argv[0], 
+        DefaultThread, DefaultHttpUrl, DefaultCount, // part1
+        DefaultFreezeMs,
+        (double)DefaultStartupSeconds, DefaultDelaySeconds, // part2
+        DefaultErrorSeconds, DefaultReportSeconds, DefaultGraceSeconds, // part2
+        argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl,
+        BuildPlatform, BugReportEmail);
+        
+    exit(0);
+}
+
+int main(int argc, char** argv){
+    int ret = ERROR_SUCCESS;
+    
+    bool show_help = false, show_version = false; 
+    string url; int threads = DefaultThread; 
+    double start = DefaultStartupSeconds, delay = DefaultDelaySeconds, error = DefaultErrorSeconds;
+    double report = DefaultReportSeconds; int count = DefaultCount; bool force = false; unsigned int seed = 0;
+    string stat_listen; double duration = 0, backoff = 0; double grace = DefaultGraceSeconds; string report_file;
+    int freeze_ms = DefaultFreezeMs;
+    
+    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count, force, seed, stat_listen, duration, backoff, grace, report_file,
+        freeze_ms)) != ERROR_SUCCESS){
+        Error("discovery options failed. ret=%d", ret);
+        return ret;
+    }
+    Trace("params url=%s, threads=%d, start=%.2f, delay=%.2f, error=%.2f, report=%.2f, count=%d", 
+        url.c_str(), threads, start, delay, error, report, count);
+    
+    if(show_help){
+        help(argv);
+    }
+    if(show_version){
+        version();
+    }
+    
+    StFarm farm;
+    
+    if((ret = farm.Initialize(report, seed)) != ERROR_SUCCESS){
+        Error("initialize the farm failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if((ret = farm.CheckLimits(threads, force)) != ERROR_SUCCESS){
+        Error("check the resource limits failed. ret=%d", ret);
+        return ret;
+    }
+    
+    StStatServer stat_server;
+    if(!stat_listen.empty() && (ret = stat_server.Listen("flv", url, stat_listen, argc, argv)) != ERROR_SUCCESS){
+        Error("start the stat server failed. ret=%d", ret);
+        return ret;
+    }
+
+    for(int i = 0; i < threads; i++){
+        StHttpFlvTask* task = new StHttpFlvTask();
+        
+        std::string task_url = build_url(url, i);
+        if((ret = task->Initialize(task_url, start, delay, error, count, freeze_ms)) != ERROR_SUCCESS){
+            Error("initialize task failed, url=%s, ret=%d", task_url.c_str(), ret);
+            return ret;
+        }
+        
+        task->SetBackoff(backoff);
+        
+        if((ret = farm.Spawn(task)) != ERROR_SUCCESS){
+            Error("st farm spwan task failed, ret=%d", ret);
+            return ret;
+        }
+    }
+    
+    if((ret = farm.WaitAll(duration, grace, report_file)) != ERROR_SUCCESS){
+        Error("wait all tasks failed. ret=%d", ret);
+        return ret;
+    }
+    
+    return 0;
+}
+
@@ -33,6 +33,7 @@ using namespace std;
 #include <htl_core_log.hpp>
 #include <htl_core_error.hpp>
 #include <htl_app_http_load.hpp>
+#include <htl_app_stat_server.hpp>
 
 #include <htl_main_utility.hpp>
 
@@ -41,7 +42,7 @@ using namespace std;
 
 int discovery_options(int argc, char** argv, 
     bool& show_help, bool& show_version, string& url, int& threads, 
-    double& startup, double& delay, double& error, double& report, int& count
+    double& startup, double& delay, double& error, double& report, int& count, bool& force, unsigned int& seed, string& stat_listen, double& duration, double& backoff, double& grace, string& report_file
 ){
     int ret = ERROR_SUCCESS;
     
@@ -52,7 +53,7 @@ int discovery_options(int argc, char** argv,
     
     int opt = 0;
     int option_index = 0;
-    while((opt = getopt_long(argc, argv, "hvc:r:t:s:d:e:m:", long_options, &option_index)) != -1){
+    while((opt = getopt_long(argc, argv, "hvfjS:l:D:b:g:R:c:r:t:s:d:e:m:", long_options, &option_index)) != -1){
         switch(opt){
             ProcessSharedOptions()
             default:
@@ -95,7 +96,7 @@ void help(char** argv){
         argv[0], argv[0], 
         DefaultThread, DefaultHttpUrl, DefaultCount, // part1
         (double)DefaultStartupSeconds, DefaultDelaySeconds, // part2
-        DefaultErrorSeconds, DefaultReportSeconds, // part2
+        DefaultErrorSeconds, DefaultReportSeconds, DefaultGraceSeconds, // part2
         argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl, argv[0], DefaultHttpUrl,
         BuildPlatform, BugReportEmail);
         
@@ -108,9 +109,10 @@ int main(int argc, char** argv){
     bool show_help = false, show_version = false; 
     string url; int threads = DefaultThread; 
     double start = DefaultStartupSeconds, delay = DefaultDelaySeconds, error = DefaultErrorSeconds;
-    double report = DefaultReportSeconds; int count = DefaultCount;
+    double report = DefaultReportSeconds; int count = DefaultCount; bool force = false; unsigned int seed = 0;
+    string stat_listen; double duration = 0, backoff = 0; double grace = DefaultGraceSeconds; string report_file;
     
-    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count)) != ERROR_SUCCESS){
+    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count, force, seed, stat_listen, duration, backoff, grace, report_file)) != ERROR_SUCCESS){
         Error("discovery options failed. ret=%d", ret);
         return ret;
     }
@@ -126,26 +128,43 @@ int main(int argc, char** argv){
     
     StFarm farm;
     
-    if((ret = farm.Initialize(report)) != ERROR_SUCCESS){
+    if((ret = farm.Initialize(report, seed)) != ERROR_SUCCESS){
         Error("initialize the farm failed. ret=%d", ret);
         return ret;
     }
+    
+    if((ret = farm.CheckLimits(threads, force)) != ERROR_SUCCESS){
+        Error("check the resource limits failed. ret=%d", ret);
+        return ret;
+    }
+    
+    StStatServer stat_server;
+    if(!stat_listen.empty() && (ret = stat_server.Listen("http", url, stat_listen, argc, argv)) != ERROR_SUCCESS){
+        Error("start the stat server failed. ret=%d", ret);
+        return ret;
+    }
 
     for(int i = 0; i < threads; i++){
         StHttpTask* task = new StHttpTask();
-
-        if((ret = task->Initialize(url, start, delay, error, count)) != ERROR_SUCCESS){
-            Error("initialize task failed, url=%s, ret=%d", url.c_str(), ret);
+        
+        std::string task_url = build_url(url, i);
+        if((ret = task->Initialize(task_url, start, delay, error, count)) != ERROR_SUCCESS){
+            Error("initialize task failed, url=%s, ret=%d", task_url.c_str(), ret);
             return ret;
         }
         
+        task->SetBackoff(backoff);
+        
         if((ret = farm.Spawn(task)) != ERROR_SUCCESS){
             Error("st farm spwan task failed, ret=%d", ret);
             return ret;
         }
     }
     
-    farm.WaitAll();
+    if((ret = farm.WaitAll(duration, grace, report_file)) != ERROR_SUCCESS){
+        Error("wait all tasks failed. ret=%d", ret);
+        return ret;
+    }
     
     return 0;
 }
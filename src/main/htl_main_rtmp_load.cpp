@@ -34,28 +34,47 @@ using namespace std;
 #include <htl_core_error.hpp>
 #include <htl_app_rtmp_load.hpp>
 #include <htl_app_rtmp_protocol.hpp>
+#include <htl_app_stat_server.hpp>
 
 #include <htl_main_utility.hpp>
 
 #define DefaultDelaySeconds 1.0
+#define DefaultFreezeMs 1000
 #define DefaultRtmpUrl "rtmp://127.0.0.1:1935/live/livestream"
 
 int discovery_options(int argc, char** argv, 
     bool& show_help, bool& show_version, string& url, int& threads, 
-    double& startup, double& delay, double& error, double& report, int& count
+    double& startup, double& delay, double& error, double& report, int& count, bool& force, unsigned int& seed, string& stat_listen, double& duration, double& backoff, double& grace, string& report_file,
+    int& packets, string& dump_video, int& freeze_ms, bool& validate
 ){
     int ret = ERROR_SUCCESS;
     
     static option long_options[] = {
         SharedOptions()
+        {"packets", required_argument, 0, 'p'},
+        {"dump-video", required_argument, 0, 'V'},
+        {"freeze", required_argument, 0, 'F'},
+        {"validate", no_argument, 0, 'a'},
         {0, 0, 0, 0}
     };
     
     int opt = 0;
     int option_index = 0;
-    while((opt = getopt_long(argc, argv, "hvc:r:t:s:d:e:m:", long_options, &option_index)) != -1){
+    while((opt = getopt_long(argc, argv, "hvfjS:l:D:b:g:R:c:r:t:s:d:e:m:p:V:F:a", long_options, &option_index)) != -1){
         switch(opt){
             ProcessSharedOptions()
+            case 'p':
+                packets = atoi(optarg);
+                break;
+            case 'V':
+                dump_video = optarg;
+                break;
+            case 'F':
+                freeze_ms = atoi(optarg);
+                break;
+            case 'a':
+                validate = true;
+                break;
             default:
                 show_help = true;
                 break;
@@ -67,6 +86,13 @@ int discovery_options(int argc, char** argv,
         show_help = true;
         return ret;
     }
+    
+    // each client must dump to its own file, or all clients truncate and interleave the same one.
+    if(!dump_video.empty() && threads > 1 && dump_video.find("{i}") == string::npos && dump_video.find("{index}") == string::npos){
+        ret = ERROR_NOT_SUPPORT;
+        Error("the dump video %s is shared by %d clients, use {i} or {index} in it. ret=%d", dump_video.c_str(), threads, ret);
+        return ret;
+    }
 
     return ret;
 }
@@ -81,6 +107,14 @@ void help(char** argv){
         "%s base on st(state-threads), support huge concurrency.\n"
         "Options:\n"
         ShowHelpPart1()
+        "  -p PACKETS, --packets PACKETS    The churn mode, disconnect after got PACKETS media packets,\n"
+        "                                   then sleep DELAY and reconnect. default: 0. 0 means never disconnect.\n"
+        "  -V DUMP, --dump-video DUMP       Dump the received h.264 to annex-b file, ie. out_{index}.h264\n"
+        "                                   the {i} or {index} is replaced by the index of client.\n"
+        "  -F MS, --freeze MS               The video freeze when no new video timestamp for MS ms.\n"
+        "                                   default: %d. 0 means never detect the freeze.\n"
+        "  -a, --validate                   Validate the received h.264 is decodable, the NALU syntax, the SPS/PPS\n"
+        "                                   before IDR and at least one complete frame, fail the client when corrupt.\n"
         ShowHelpPart2()
         "\n"
         "Examples:\n"
@@ -97,8 +131,9 @@ void help(char** argv){
         "Report bugs to <%s>\n",
         argv[0], argv[0], 
         DefaultThread, DefaultRtmpUrl, DefaultCount, // part1
+        DefaultFreezeMs,
         (double)DefaultStartupSeconds, DefaultDelaySeconds, // part2
-        DefaultErrorSeconds, DefaultReportSeconds, // part2
+        DefaultErrorSeconds, DefaultReportSeconds, DefaultGraceSeconds, // part2
         argv[0], DefaultRtmpUrl, argv[0], DefaultRtmpUrl, argv[0], DefaultRtmpUrl, argv[0], DefaultRtmpUrl,
         BuildPlatform, BugReportEmail);
         
@@ -111,9 +146,12 @@ int main(int argc, char** argv){
     bool show_help = false, show_version = false; 
     string url; int threads = DefaultThread; 
     double start = DefaultStartupSeconds, delay = DefaultDelaySeconds, error = DefaultErrorSeconds;
-    double report = DefaultReportSeconds; int count = DefaultCount;
+    double report = DefaultReportSeconds; int count = DefaultCount; bool force = false; unsigned int seed = 0;
+    string stat_listen; double duration = 0, backoff = 0; double grace = DefaultGraceSeconds; string report_file;
+    int packets = 0; string dump_video; int freeze_ms = DefaultFreezeMs; bool validate = false;
     
-    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count)) != ERROR_SUCCESS){
+    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count, force, seed, stat_listen, duration, backoff, grace, report_file,
+        packets, dump_video, freeze_ms, validate)) != ERROR_SUCCESS){
         Error("discovery options failed. ret=%d", ret);
         return ret;
     }
@@ -129,26 +167,46 @@ int main(int argc, char** argv){
     
     StFarm farm;
     
-    if((ret = farm.Initialize(report)) != ERROR_SUCCESS){
+    if((ret = farm.Initialize(report, seed)) != ERROR_SUCCESS){
         Error("initialize the farm failed. ret=%d", ret);
         return ret;
     }
+    
+    // each player opens a file to dump the video.
+    if((ret = farm.CheckLimits(threads, dump_video.empty()? 0 : 1, 0, force)) != ERROR_SUCCESS){
+        Error("check the resource limits failed. ret=%d", ret);
+        return ret;
+    }
+    
+    StStatServer stat_server;
+    if(!stat_listen.empty() && (ret = stat_server.Listen("play", url, stat_listen, argc, argv)) != ERROR_SUCCESS){
+        Error("start the stat server failed. ret=%d", ret);
+        return ret;
+    }
 
     for(int i = 0; i < threads; i++){
         StRtmpTask* task = new StRtmpTask();
-
-        if((ret = task->Initialize(url, start, delay, error, count)) != ERROR_SUCCESS){
-            Error("initialize task failed, url=%s, ret=%d", url.c_str(), ret);
+        
+        std::string task_url = build_url(url, i);
+        std::string task_dump_video = dump_video.empty()? "" : build_url(dump_video, i);
+        if((ret = task->Initialize(task_url, start, delay, error, count, packets, task_dump_video, freeze_ms)) != ERROR_SUCCESS){
+            Error("initialize task failed, url=%s, ret=%d", task_url.c_str(), ret);
             return ret;
         }
         
+        task->SetBackoff(backoff);
+        task->SetValidate(validate);
+        
         if((ret = farm.Spawn(task)) != ERROR_SUCCESS){
             Error("st farm spwan task failed, ret=%d", ret);
             return ret;
         }
     }
     
-    farm.WaitAll();
+    if((ret = farm.WaitAll(duration, grace, report_file)) != ERROR_SUCCESS){
+        Error("wait all tasks failed. ret=%d", ret);
+        return ret;
+    }
     
     return 0;
 }
@@ -27,6 +27,7 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 #include <stdlib.h>
 
 #include <string>
+#include <algorithm>
 using namespace std;
 
 // project lib
@@ -34,6 +35,8 @@ using namespace std;
 #include <htl_core_error.hpp>
 #include <htl_app_rtmp_load.hpp>
 #include <htl_app_rtmp_protocol.hpp>
+#include <htl_app_rtmp_publish.hpp>
+#include <htl_app_stat_server.hpp>
 
 #include <htl_main_utility.hpp>
 
@@ -41,28 +44,62 @@ using namespace std;
 #define DefaultRtmpUrlSingle "rtmp://127.0.0.1:1935/live/livestream"
 #define DefaultRtmpUrl "rtmp://127.0.0.1:1935/live/livestream_{i}"
 #define DefaultInputFlv "doc/source.200kbps.768x320.flv"
+#define DefaultSwitchSeconds 10.0
 
 int discovery_options(int argc, char** argv, 
     bool& show_help, bool& show_version, string& url, int& threads, 
-    double& startup, double& delay, double& error, double& report, int& count,
-    string& input
+    double& startup, double& delay, double& error, double& report, int& count, bool& force, unsigned int& seed, string& stat_listen, double& duration, double& backoff, double& grace, string& report_file,
+    string& input, bool& validate, bool& truncate, bool& audio_only, bool& video_only, int& bitrate,
+    string& switch_input, double& switch_after
 ){
     int ret = ERROR_SUCCESS;
     
     static option long_options[] = {
         SharedOptions()
-        {"input", no_argument, 0, 'i'},
+        {"input", required_argument, 0, 'i'},
+        {"validate", no_argument, 0, 'a'},
+        {"truncate", no_argument, 0, 'k'},
+        {"audio-only", no_argument, 0, 'A'},
+        {"video-only", no_argument, 0, 'O'},
+        {"bitrate", required_argument, 0, 'B'},
+        {"switch", required_argument, 0, 'w'},
+        {"switch-after", required_argument, 0, 'W'},
         {0, 0, 0, 0}
     };
     
     int opt = 0;
     int option_index = 0;
-    while((opt = getopt_long(argc, argv, "hvc:r:t:s:d:e:m:i:", long_options, &option_index)) != -1){
+    while((opt = getopt_long(argc, argv, "hvfjS:l:D:b:g:R:c:r:t:s:d:e:m:i:akAOB:w:W:", long_options, &option_index)) != -1){
         switch(opt){
             ProcessSharedOptions()
             case 'i':
                 input = optarg;
                 break;
+            case 'a':
+                validate = true;
+                break;
+            case 'k':
+                validate = truncate = true;
+                break;
+            case 'A':
+                audio_only = true;
+                break;
+            case 'O':
+                video_only = true;
+                break;
+            case 'B':
+                bitrate = atoi(optarg);
+                break;
+            case 'w':
+                switch_input = optarg;
+                break;
+            case 'W':
+                if((switch_after = parse_duration(optarg)) <= 0){
+                    ret = ERROR_NOT_SUPPORT;
+                    Error("invalid switch-after %s, should be positive seconds, or with unit s/m/h, ie. 1m. ret=%d", optarg, ret);
+                    return ret;
+                }
+                break;
             default:
                 show_help = true;
                 break;
@@ -74,6 +111,13 @@ int discovery_options(int argc, char** argv,
         show_help = true;
         return ret;
     }
+    
+    // at least one kind of media to publish.
+    if(audio_only && video_only){
+        ret = ERROR_NOT_SUPPORT;
+        Error("audio-only and video-only are exclusive, nothing to publish. ret=%d", ret);
+        return ret;
+    }
 
     return ret;
 }
@@ -88,6 +132,16 @@ void help(char** argv){
         "%s base on st(state-threads), support huge concurrency.\n"
         "Options:\n"
         ShowHelpPart1()
+        "  -i INPUT, --input INPUT          The flv file to publish, loop when EOF.\n"
+        "  -a, --validate                   Validate all tags of input before publish, quit when corrupt.\n"
+        "  -k, --truncate                   Validate input and only publish the tags before the corrupt one.\n"
+        "  -A, --audio-only                 Publish the audio tags only, drop the video.\n"
+        "  -O, --video-only                 Publish the video tags only, drop the audio.\n"
+        "  -B KBPS, --bitrate KBPS          Shape the video to the target bitrate, drop the non-reference frames\n"
+        "                                   or wait before frames. default: 0. 0 means publish as is.\n"
+        "  -w FLV, --switch FLV             Switch to another flv once after AFTER of each publish, ie. with a different\n"
+        "                                   resolution, the SPS/PPS changes without republish and the timestamp continues.\n"
+        "  -W AFTER, --switch-after AFTER   The seconds to publish before switch, or with unit s/m/h. default: %.0f\n"
         ShowHelpPart2()
         "\n"
         "Examples:\n"
@@ -104,8 +158,9 @@ void help(char** argv){
         "Report bugs to <%s>\n",
         argv[0], argv[0], 
         DefaultThread, DefaultRtmpUrl, DefaultCount, // part1
+        DefaultSwitchSeconds,
         (double)DefaultStartupSeconds, DefaultDelaySeconds, // part2
-        DefaultErrorSeconds, DefaultReportSeconds, // part2
+        DefaultErrorSeconds, DefaultReportSeconds, DefaultGraceSeconds, // part2
         argv[0], DefaultInputFlv, DefaultRtmpUrlSingle, 
         argv[0], DefaultInputFlv, DefaultRtmpUrl, 
         argv[0], DefaultInputFlv, DefaultRtmpUrl, 
@@ -121,10 +176,13 @@ int main(int argc, char** argv){
     bool show_help = false, show_version = false; 
     string url; int threads = DefaultThread; 
     double start = DefaultStartupSeconds, delay = DefaultDelaySeconds, error = DefaultErrorSeconds;
-    double report = DefaultReportSeconds; int count = DefaultCount;
-    string input;
+    double report = DefaultReportSeconds; int count = DefaultCount; bool force = false; unsigned int seed = 0;
+    string stat_listen; double duration = 0, backoff = 0; double grace = DefaultGraceSeconds; string report_file;
+    string input; bool validate = false, truncate = false; bool audio_only = false, video_only = false; int bitrate = 0;
+    string switch_input; double switch_after = DefaultSwitchSeconds;
     
-    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count, input)) != ERROR_SUCCESS){
+    if((ret = discovery_options(argc, argv, show_help, show_version, url, threads, start, delay, error, report, count, force, seed, stat_listen, duration, backoff, grace, report_file, 
+        input, validate, truncate, audio_only, video_only, bitrate, switch_input, switch_after)) != ERROR_SUCCESS){
         Error("discovery options failed. ret=%d", ret);
         return ret;
     }
@@ -136,42 +194,78 @@ int main(int argc, char** argv){
         version();
     }
     
-    Trace("params url=%s, threads=%d, start=%.2f, delay=%.2f, error=%.2f, report=%.2f, count=%d", 
-        url.c_str(), threads, start, delay, error, report, count);
+    Trace("params url=%s, threads=%d, start=%.2f, delay=%.2f, error=%.2f, report=%.2f, count=%d, input=%s, validate=%d, truncate=%d, audio_only=%d, video_only=%d, bitrate=%d, switch=%s, switch_after=%.2f", 
+        url.c_str(), threads, start, delay, error, report, count, input.c_str(), validate, truncate, audio_only, video_only, bitrate, 
+        switch_input.c_str(), switch_after);
+    
+    if(validate && (ret = StFlvSource::Validate(input, truncate)) != ERROR_SUCCESS){
+        Error("validate the input flv failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if((ret = StFlvSource::CheckMedia(input, !video_only, !audio_only)) != ERROR_SUCCESS){
+        Error("check the media of input flv failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if(!switch_input.empty() && validate && (ret = StFlvSource::Validate(switch_input, truncate)) != ERROR_SUCCESS){
+        Error("validate the switch flv failed. ret=%d", ret);
+        return ret;
+    }
+    
+    if(!switch_input.empty() && (ret = StFlvSource::CheckMedia(switch_input, !video_only, !audio_only)) != ERROR_SUCCESS){
+        Error("check the media of switch flv failed. ret=%d", ret);
+        return ret;
+    }
     
     StFarm farm;
     
-    if((ret = farm.Initialize(report)) != ERROR_SUCCESS){
+    if((ret = farm.Initialize(report, seed)) != ERROR_SUCCESS){
         Error("initialize the farm failed. ret=%d", ret);
         return ret;
     }
+    
+    // each publisher opens the flv file, and reads a tag to memory.
+    // the input is closed before open the switch flv, so the fd is not increased.
+    int64_t max_tag = StFlvSource::GetMaxTagSize(input);
+    if(!switch_input.empty()){
+        max_tag = std::max(max_tag, StFlvSource::GetMaxTagSize(switch_input));
+    }
+    if((ret = farm.CheckLimits(threads, 1, (max_tag > 0)? max_tag : 0, force)) != ERROR_SUCCESS){
+        Error("check the resource limits failed. ret=%d", ret);
+        return ret;
+    }
+    
+    StStatServer stat_server;
+    if(!stat_listen.empty() && (ret = stat_server.Listen("publish", url, stat_listen, argc, argv)) != ERROR_SUCCESS){
+        Error("start the stat server failed. ret=%d", ret);
+        return ret;
+    }
 
     
     for(int i = 0; i < threads; i++){
         StRtmpPublishTask* task = new StRtmpPublishTask();
-
-        char index[16];
-        snprintf(index, sizeof(index), "%d", i);
-        
-        std::string _index = index;
-        std::string rtmp_url = url;
-        size_t pos = std::string::npos;
-        if ((pos = rtmp_url.find("{i}")) != std::string::npos) {
-            rtmp_url = rtmp_url.replace(pos, 3, _index);
-        }
         
-        if((ret = task->Initialize(input, rtmp_url, start, delay, error, count)) != ERROR_SUCCESS){
+        std::string rtmp_url = build_url(url, i);
+        if((ret = task->Initialize(input, rtmp_url, start, delay, error, count, !video_only, !audio_only)) != ERROR_SUCCESS){
             Error("initialize task failed, input=%s, url=%s, ret=%d", input.c_str(), rtmp_url.c_str(), ret);
             return ret;
         }
         
+        task->SetBackoff(backoff);
+        task->SetBitrate(bitrate);
+        task->SetSwitch(switch_input, switch_after);
+        
         if((ret = farm.Spawn(task)) != ERROR_SUCCESS){
             Error("st farm spwan task failed, ret=%d", ret);
             return ret;
         }
     }
     
-    farm.WaitAll();
+    if((ret = farm.WaitAll(duration, grace, report_file)) != ERROR_SUCCESS){
+        Error("wait all tasks failed. ret=%d", ret);
+        return ret;
+    }
     
     return 0;
 }
@@ -35,6 +35,7 @@ LogContext* context = new StLogContext();
 #define DefaultStartupSeconds 5.0
 #define DefaultErrorSeconds 3.0
 #define DefaultReportSeconds 30.0
+#define DefaultGraceSeconds 3.0
 #define DefaultCount 0
 
 #define SharedOptions()\
@@ -46,6 +47,14 @@ LogContext* context = new StLogContext();
         {"delay", required_argument, 0, 'd'}, \
         {"error", required_argument, 0, 'e'}, \
         {"summary", required_argument, 0, 'm'}, \
+        {"force", no_argument, 0, 'f'}, \
+        {"seed", required_argument, 0, 'S'}, \
+        {"stat-listen", required_argument, 0, 'l'}, \
+        {"duration", required_argument, 0, 'D'}, \
+        {"backoff", required_argument, 0, 'b'}, \
+        {"json-log", no_argument, 0, 'j'}, \
+        {"grace", required_argument, 0, 'g'}, \
+        {"report", required_argument, 0, 'R'}, \
         \
         {"help", no_argument, 0, 'h'}, \
         {"version", no_argument, 0, 'v'},
@@ -77,11 +86,41 @@ LogContext* context = new StLogContext();
                 break; \
             case 'm': \
                 report = atof(optarg); \
+                break; \
+            case 'f': \
+                force = true; \
+                break; \
+            case 'S': \
+                seed = (unsigned int)strtoul(optarg, NULL, 10); \
+                break; \
+            case 'l': \
+                stat_listen = optarg; \
+                break; \
+            case 'D': \
+                if((duration = parse_duration(optarg)) < 0){ \
+                    ret = ERROR_NOT_SUPPORT; \
+                    Error("invalid duration %s, should be seconds, or with unit s/m/h, ie. 10m. ret=%d", optarg, ret); \
+                    return ret; \
+                } \
+                break; \
+            case 'j': \
+                context->SetJson(true); \
+                break; \
+            case 'b': \
+                backoff = atof(optarg); \
+                break; \
+            case 'g': \
+                grace = atof(optarg); \
+                break; \
+            case 'R': \
+                report_file = optarg; \
                 break;
 
 #define ShowHelpPart1()\
         "  -c CLIENTS, --clients CLIENTS    The concurrency client to start to request. defaut: %d\n" \
         "  -r URL, --url URL                The load test url for each client to download/process. \n" \
+        "                                   the {i} or {index} in url is replaced by the index of client,\n" \
+        "                                   the {rand} in url is replaced by a random token of client.\n" \
         "  -t REPEAT, --repeat REPEAT       The repeat is the number for each client to download the url. \n" \
         "                                   ie. %s\n" \
         "                                   default: %d. 0 means infinity.\n"
@@ -97,9 +136,84 @@ LogContext* context = new StLogContext();
         "                                   duration is the running time in seconds, tduration is the avarage duation of tasks.\n" \
         "                                   nread/nwrite in Mbps, duration/tduration in seconds.\n" \
         "                                   defaut: %.2f. 0 means no delay. \n" \
+        "  -D DURATION, --duration DURATION The run time, then stop all clients at the same time and quit.\n" \
+        "                                   in seconds, or with unit s/m/h, ie. 10m. default: 0. 0 means forever.\n" \
+        "  -b BACKOFF, --backoff BACKOFF    The max seconds of exponential backoff when error, which start from ERROR,\n" \
+        "                                   double for each continuous error with random jitter.\n" \
+        "                                   default: 0. 0 means always sleep ERROR.\n" \
+        "  -g GRACE, --grace GRACE          The max seconds to wait for clients to quit when SIGINT/SIGTERM.\n" \
+        "                                   default: %.2f.\n" \
+        "  -R REPORT, --report REPORT       Write the summary of run to the REPORT file in json when quit.\n" \
+        "  -f, --force                      Start even if the clients exceed the fd or memory limits.\n" \
+        "  -S SEED, --seed SEED             The master seed for all random sleeps, to reproduce a run.\n" \
+        "                                   default: 0. 0 means generate one by time.\n" \
+        "  -l ENDPOINT, --stat-listen ENDPOINT  The http endpoint to query the live statistic, ie. :6060\n" \
+        "                                   GET / for summary, GET /api/v1/clients for each client,\n" \
+        "                                   GET /metrics for prometheus.\n" \
+        "  -j, --json-log                   Write the log in json lines, for post-processing.\n" \
         "  -v, --version                    Print the version and exit.\n" \
         "  -h, --help                       Print this help message and exit.\n"
         
+// replace all key in str with value.
+std::string replace_all(std::string str, std::string key, std::string value){
+    size_t pos = 0;
+    while ((pos = str.find(key, pos)) != std::string::npos) {
+        str = str.replace(pos, key.length(), value);
+        pos += value.length();
+    }
+    return str;
+}
+
+// build the url for the client of index, 
+// for instance, rtmp://127.0.0.1/live/livestream_{i} to rtmp://127.0.0.1/live/livestream_0
+// where the {i} or {index} is the index of client, the {rand} is a random token,
+// which is reproducible by the --seed.
+std::string build_url(std::string url, int index){
+    char _index[16];
+    snprintf(_index, sizeof(_index), "%d", index);
+    
+    url = replace_all(url, "{i}", _index);
+    url = replace_all(url, "{index}", _index);
+    
+    if (url.find("{rand}") != std::string::npos) {
+        unsigned int seed = StUtility::BuildRandomSeed(index, "url");
+        
+        char _rand[16];
+        snprintf(_rand, sizeof(_rand), "%08x", (unsigned int)rand_r(&seed));
+        url = replace_all(url, "{rand}", _rand);
+    }
+    
+    return url;
+}
+
+// parse the duration in seconds, with optional unit s/m/h, 
+// for instance, 30 or 30s to 30, 10m to 600, 1h to 3600.
+// @return -1 when invalid, for the 0 means forever.
+double parse_duration(const char* str){
+    char* unit = NULL;
+    double value = strtod(str, &unit);
+    
+    // no number, or negative.
+    if (unit == str || value < 0) {
+        return -1;
+    }
+    
+    if (*unit == 'm') {
+        value *= 60;
+    } else if (*unit == 'h') {
+        value *= 3600;
+    } else if (*unit != 's' && *unit != '\0') {
+        return -1;
+    }
+    
+    // nothing after the unit.
+    if (*unit != '\0' && unit[1] != '\0') {
+        return -1;
+    }
+    
+    return value;
+}
+
 void version(){
     printf(ProductVersion);
     exit(0);
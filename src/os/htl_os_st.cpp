@@ -29,6 +29,9 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 #include <stdlib.h>
 #include <sys/time.h>
 #include <inttypes.h>
+#include <sys/resource.h>
+#include <signal.h>
+#include <stdio.h>
 
 // socket
 #include <sys/socket.h>
@@ -39,6 +42,8 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 #include <netdb.h>
 
 #include <string>
+#include <vector>
+#include <algorithm>
 using namespace std;
 
 #include <htl_core_error.hpp>
@@ -46,62 +51,414 @@ using namespace std;
 
 #include <htl_os_st.hpp>
 
+StClientStatistic::StClientStatistic(){
+    tid = 0;
+    alive = false;
+    nread = nwrite = 0;
+    tasks = err_tasks = sub_tasks = err_sub_tasks = 0;
+    first_audio = first_video = -1;
+    reconnects = 0;
+    video_kbps = video_fps = -1;
+    freezes = max_freeze = 0;
+    sequence_changes = 0;
+}
+
+// the upper bounds in ms of histogram buckets, the last is +Inf.
+static int64_t _histogram_bounds[StHistogramBuckets] = {
+    50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, -1
+};
+
+StHistogram::StHistogram(){
+    count = sum = 0;
+    for(int i = 0; i < StHistogramBuckets; i++){
+        buckets[i] = 0;
+    }
+}
+
+StHistogram::~StHistogram(){
+}
+
+void StHistogram::Update(int64_t value){
+    count++;
+    sum += value;
+    
+    for(int i = 0; i < StHistogramBuckets; i++){
+        if(_histogram_bounds[i] < 0 || value <= _histogram_bounds[i]){
+            buckets[i]++;
+        }
+    }
+}
+
+int64_t StHistogram::GetCount(){
+    return count;
+}
+
+int64_t StHistogram::GetSum(){
+    return sum;
+}
+
+int64_t StHistogram::GetBucket(int index){
+    return buckets[index];
+}
+
+int64_t StHistogram::GetBound(int index){
+    return _histogram_bounds[index];
+}
+
+StSamples::StSamples(){
+    count = 0;
+    sorted = true;
+    // a fixed seed, never consume the random of the load test.
+    seed = 0;
+}
+
+StSamples::~StSamples(){
+}
+
+void StSamples::Update(int64_t value){
+    count++;
+    sorted = false;
+    
+    if((int)values.size() < StSamplesMax){
+        values.push_back(value);
+        return;
+    }
+    
+    // replace a random sample, so each value is kept in the probability of StSamplesMax/count.
+    int64_t index = ((int64_t)rand_r(&seed) * ((int64_t)RAND_MAX + 1) + rand_r(&seed)) % count;
+    if(index < StSamplesMax){
+        values[index] = value;
+    }
+}
+
+int64_t StSamples::GetCount(){
+    return count;
+}
+
+int64_t StSamples::GetPercentile(double p){
+    if(values.empty()){
+        return -1;
+    }
+    
+    // the order of reservoir is not used, so sort in place.
+    if(!sorted){
+        std::sort(values.begin(), values.end());
+        sorted = true;
+    }
+    
+    size_t index = (size_t)(p * (values.size() - 1) + 0.5);
+    return values.at(index < values.size()? index : values.size() - 1);
+}
+
 StStatistic::StStatistic(){
     starttime = StUtility::GetCurrentTime();
     task_duration = 0;
     threads = alive = 0;
     nread = nwrite = 0;
     tasks = err_tasks = sub_tasks = err_sub_tasks = 0;
+    started = 0;
+    freezes = max_freeze = 0;
+    sequence_changes = max_sequence_gap = 0;
+    segment_bytes = 0;
+    stales = 0;
+    complete_frames = incomplete_frames = 0;
+    valid_streams = invalid_streams = 0;
+    quiting = false;
 }
 
 StStatistic::~StStatistic(){
 }
 
-void StStatistic::OnRead(int /*tid*/, ssize_t nread_bytes){
+void StStatistic::OnRead(int tid, ssize_t nread_bytes){
     this->nread += nread_bytes;
+    Client(tid).nread += nread_bytes;
 }
 
-void StStatistic::OnWrite(int /*tid*/, ssize_t nwrite_bytes){
+void StStatistic::OnWrite(int tid, ssize_t nwrite_bytes){
     this->nwrite += nwrite_bytes;
+    Client(tid).nwrite += nwrite_bytes;
 }
 
-void StStatistic::OnThreadRun(int /*tid*/){
+void StStatistic::OnThreadRun(int tid){
     threads++;
+    started++;
+    Client(tid);
 }
 
-void StStatistic::OnThreadQuit(int /*tid*/){
+void StStatistic::OnThreadQuit(int tid){
     threads--;
+    clients.erase(tid);
 }
 
-void StStatistic::OnTaskStart(int /*tid*/, std::string /*task_url*/){
+void StStatistic::OnTaskStart(int tid, std::string task_url){
     alive++;
     tasks++;
+    
+    StClientStatistic& client = Client(tid);
+    client.url = task_url;
+    client.alive = true;
+    client.tasks++;
+    client.first_audio = client.first_video = -1;
+    client.video_kbps = client.video_fps = -1;
 }
 
-void StStatistic::OnTaskError(int /*tid*/, int duration_seconds){
+void StStatistic::OnTaskError(int tid, int duration_seconds, int error_code){
+    if(quiting){
+        OnTaskEnd(tid, duration_seconds);
+        return;
+    }
+    
+    errors[error_code]++;
     alive--;
     err_tasks++;
     this->task_duration += duration_seconds * 1000;
+    
+    StClientStatistic& client = Client(tid);
+    client.alive = false;
+    client.err_tasks++;
 }
 
-void StStatistic::OnTaskEnd(int /*tid*/, int duration_seconds){
+void StStatistic::OnTaskEnd(int tid, int duration_seconds){
     alive--;
     this->task_duration += duration_seconds * 1000;
+    
+    Client(tid).alive = false;
 }
 
-void StStatistic::OnSubTaskStart(int /*tid*/, std::string /*sub_task_url*/){
+void StStatistic::OnSubTaskStart(int tid, std::string /*sub_task_url*/){
     sub_tasks++;
+    Client(tid).sub_tasks++;
 }
 
-void StStatistic::OnSubTaskError(int /*tid*/, int duration_seconds){
+void StStatistic::OnSubTaskError(int tid, int duration_seconds, int error_code){
+    if(quiting){
+        OnSubTaskEnd(tid, duration_seconds);
+        return;
+    }
+    
+    errors[error_code]++;
     err_sub_tasks++;
     this->task_duration += duration_seconds * 1000;
+    Client(tid).err_sub_tasks++;
 }
 
 void StStatistic::OnSubTaskEnd(int /*tid*/, int duration_seconds){
     this->task_duration += duration_seconds * 1000;
 }
 
+void StStatistic::OnFirstPacket(int /*tid*/, int64_t duration_ms){
+    first_packet.Update(duration_ms);
+}
+
+void StStatistic::OnFirstAudio(int tid, int64_t duration_ms){
+    first_audio.Update(duration_ms);
+    Client(tid).first_audio = duration_ms;
+}
+
+void StStatistic::OnFirstVideo(int tid, int64_t duration_ms){
+    first_video.Update(duration_ms);
+    Client(tid).first_video = duration_ms;
+}
+
+void StStatistic::OnSetup(int /*tid*/, int64_t duration_ms){
+    setup.Update(duration_ms);
+}
+
+void StStatistic::OnReconnect(int tid){
+    reconnects[tid]++;
+    Client(tid).reconnects++;
+}
+
+void StStatistic::OnVideoQuality(int tid, int kbps, int fps){
+    StClientStatistic& client = Client(tid);
+    client.video_kbps = kbps;
+    client.video_fps = fps;
+}
+
+void StStatistic::OnFreeze(int tid, int64_t duration_ms){
+    freezes++;
+    max_freeze = std::max(max_freeze, duration_ms);
+    
+    StClientStatistic& client = Client(tid);
+    client.freezes++;
+    client.max_freeze = std::max(client.max_freeze, duration_ms);
+}
+
+void StStatistic::OnFreezing(int tid, int64_t duration_ms){
+    max_freeze = std::max(max_freeze, duration_ms);
+    
+    StClientStatistic& client = Client(tid);
+    client.max_freeze = std::max(client.max_freeze, duration_ms);
+}
+
+void StStatistic::OnSequenceChange(int tid, int64_t gap_ms){
+    sequence_changes++;
+    max_sequence_gap = std::max(max_sequence_gap, gap_ms);
+    Client(tid).sequence_changes++;
+}
+
+void StStatistic::OnSegment(int /*tid*/, int64_t duration_ms, int64_t bytes){
+    segment.Update(duration_ms);
+    segment_bytes += bytes;
+}
+
+void StStatistic::OnStale(int /*tid*/){
+    stales++;
+}
+
+void StStatistic::OnVideoFrame(int /*tid*/, bool complete){
+    if(complete){
+        complete_frames++;
+    }else{
+        incomplete_frames++;
+    }
+}
+
+void StStatistic::OnVideoValidate(int /*tid*/, bool valid){
+    if(valid){
+        valid_streams++;
+    }else{
+        invalid_streams++;
+    }
+}
+
+void StStatistic::OnQuit(){
+    quiting = true;
+}
+
+int StStatistic::GetThreads(){
+    return threads;
+}
+
+int StStatistic::GetAlive(){
+    return alive;
+}
+
+int64_t StStatistic::GetDuration(){
+    return StUtility::GetCurrentTime() - starttime;
+}
+
+int64_t StStatistic::GetTaskDuration(){
+    return task_duration;
+}
+
+int64_t StStatistic::GetReadBytes(){
+    return nread;
+}
+
+int64_t StStatistic::GetWriteBytes(){
+    return nwrite;
+}
+
+int64_t StStatistic::GetTasks(){
+    return tasks;
+}
+
+int64_t StStatistic::GetErrorTasks(){
+    return err_tasks;
+}
+
+int64_t StStatistic::GetSubTasks(){
+    return sub_tasks;
+}
+
+int64_t StStatistic::GetErrorSubTasks(){
+    return err_sub_tasks;
+}
+
+StHistogram* StStatistic::GetFirstPacket(){
+    return &first_packet;
+}
+
+StSamples* StStatistic::GetFirstAudio(){
+    return &first_audio;
+}
+
+StSamples* StStatistic::GetFirstVideo(){
+    return &first_video;
+}
+
+StSamples* StStatistic::GetSetup(){
+    return &setup;
+}
+
+int64_t StStatistic::GetFreezes(){
+    return freezes;
+}
+
+int64_t StStatistic::GetMaxFreeze(){
+    return max_freeze;
+}
+
+StSamples* StStatistic::GetSegment(){
+    return &segment;
+}
+
+int64_t StStatistic::GetSequenceChanges(){
+    return sequence_changes;
+}
+
+int64_t StStatistic::GetMaxSequenceGap(){
+    return max_sequence_gap;
+}
+
+int64_t StStatistic::GetSegmentBytes(){
+    return segment_bytes;
+}
+
+int64_t StStatistic::GetStales(){
+    return stales;
+}
+
+void StStatistic::GetVideoQuality(int* pclients, int64_t* pkbps, int64_t* pfps){
+    int nb_video = 0; int64_t kbps = 0, fps = 0;
+    for(std::map<int, StClientStatistic>::iterator it = clients.begin(); it != clients.end(); ++it){
+        if(it->second.alive && it->second.video_fps >= 0){
+            nb_video++;
+            kbps += it->second.video_kbps;
+            fps += it->second.video_fps;
+        }
+    }
+    
+    *pclients = nb_video;
+    *pkbps = (nb_video > 0)? kbps / nb_video : 0;
+    *pfps = (nb_video > 0)? fps / nb_video : 0;
+}
+
+int64_t StStatistic::GetCompleteFrames(){
+    return complete_frames;
+}
+
+int64_t StStatistic::GetIncompleteFrames(){
+    return incomplete_frames;
+}
+
+int64_t StStatistic::GetValidStreams(){
+    return valid_streams;
+}
+
+int64_t StStatistic::GetInvalidStreams(){
+    return invalid_streams;
+}
+
+StClientStatistic* StStatistic::GetClient(int tid){
+    std::map<int, StClientStatistic>::iterator it = clients.find(tid);
+    if(it == clients.end()){
+        return NULL;
+    }
+    return &it->second;
+}
+
+std::map<int, StClientStatistic>& StStatistic::GetClients(){
+    return clients;
+}
+
+StClientStatistic& StStatistic::Client(int tid){
+    StClientStatistic& client = clients[tid];
+    client.tid = tid;
+    return client;
+}
+
 void StStatistic::DoReport(double sleep_ms){
     for(;;){
         int64_t duration = StUtility::GetCurrentTime() - starttime;
@@ -121,10 +478,130 @@ void StStatistic::DoReport(double sleep_ms){
             getpid(), threads, alive, duration/1000.0, avarage_duration, read_mbps, write_mbps, 
             tasks, err_tasks, sub_tasks, err_sub_tasks);
         
+        if(setup.GetCount() > 0){
+            LReport("[report] [%d] setup p50:%"PRId64" p95:%"PRId64" p99:%"PRId64", "
+                "first audio p50:%"PRId64" p95:%"PRId64" p99:%"PRId64", "
+                "first video p50:%"PRId64" p95:%"PRId64" p99:%"PRId64" (ms)", getpid(),
+                setup.GetPercentile(0.5), setup.GetPercentile(0.95), setup.GetPercentile(0.99),
+                first_audio.GetPercentile(0.5), first_audio.GetPercentile(0.95), first_audio.GetPercentile(0.99),
+                first_video.GetPercentile(0.5), first_video.GetPercentile(0.95), first_video.GetPercentile(0.99));
+        }
+        
+        // the average of players which got video, or publishers which sent video in last second.
+        int nb_video = 0; int64_t kbps = 0, fps = 0;
+        GetVideoQuality(&nb_video, &kbps, &fps);
+        if(nb_video > 0 || freezes > 0){
+            LReport("[report] [%d] video clients:%d kbps:%"PRId64" fps:%"PRId64" freezes:%"PRId64" max_freeze:%"PRId64"ms "
+                "sequence_changes:%"PRId64" max_sequence_gap:%"PRId64"ms", 
+                getpid(), nb_video, kbps, fps, freezes, max_freeze, sequence_changes, max_sequence_gap);
+        }
+        
+        if(segment.GetCount() > 0){
+            LReport("[report] [%d] segment p50:%"PRId64" p95:%"PRId64" p99:%"PRId64" (ms) bytes:%"PRId64" stales:%"PRId64, getpid(),
+                segment.GetPercentile(0.5), segment.GetPercentile(0.95), segment.GetPercentile(0.99), segment_bytes, stales);
+        }
+        
+        if(complete_frames > 0 || incomplete_frames > 0 || invalid_streams > 0){
+            LReport("[report] [%d] h264 frames complete:%"PRId64" incomplete:%"PRId64" streams valid:%"PRId64" invalid:%"PRId64, 
+                getpid(), complete_frames, incomplete_frames, valid_streams, invalid_streams);
+        }
+        
         st_usleep((st_utime_t)(sleep_ms * 1000));
     }
 }
 
+// the max number of error codes in summary.
+#define SummaryTopErrors 5
+
+int StStatistic::Summary(string report_file){
+    int ret = ERROR_SUCCESS;
+    
+    int64_t duration = StUtility::GetCurrentTime() - starttime;
+    
+    // sort the error codes by count.
+    std::vector< std::pair<int64_t, int> > top_errors;
+    for(std::map<int, int64_t>::iterator it = errors.begin(); it != errors.end(); ++it){
+        top_errors.push_back(std::make_pair(it->second, it->first));
+    }
+    std::sort(top_errors.rbegin(), top_errors.rend());
+    if(top_errors.size() > SummaryTopErrors){
+        top_errors.resize(SummaryTopErrors);
+    }
+    
+    // the total and max reconnects of clients.
+    int64_t total_reconnects = 0, max_reconnects = 0;
+    for(std::map<int, int64_t>::iterator it = reconnects.begin(); it != reconnects.end(); ++it){
+        total_reconnects += it->second;
+        max_reconnects = std::max(max_reconnects, it->second);
+    }
+    
+    LReport("[summary] [%d] duration:%.2fs clients:%"PRId64" tasks:%"PRId64" succeed:%"PRId64" failed:%"PRId64" "
+        "stasks:%"PRId64" estasks:%"PRId64" nread:%"PRId64"B nwrite:%"PRId64"B reconnects:%"PRId64" max_reconnects:%"PRId64, 
+        getpid(), duration / 1000.0, started, tasks, tasks - err_tasks - alive, err_tasks, 
+        sub_tasks, err_sub_tasks, nread, nwrite, total_reconnects, max_reconnects);
+    if(freezes > 0 || first_video.GetCount() > 0){
+        LReport("[summary] [%d] video freezes:%"PRId64" max_freeze:%"PRId64"ms sequence_changes:%"PRId64" max_sequence_gap:%"PRId64"ms", 
+            getpid(), freezes, max_freeze, sequence_changes, max_sequence_gap);
+    }
+    if(segment.GetCount() > 0){
+        LReport("[summary] [%d] segments:%"PRId64" p50:%"PRId64" p95:%"PRId64" p99:%"PRId64" (ms) bytes:%"PRId64" stales:%"PRId64, getpid(),
+            segment.GetCount(), segment.GetPercentile(0.5), segment.GetPercentile(0.95), segment.GetPercentile(0.99), segment_bytes, stales);
+    }
+    if(complete_frames > 0 || incomplete_frames > 0 || valid_streams > 0 || invalid_streams > 0){
+        LReport("[summary] [%d] h264 frames complete:%"PRId64" incomplete:%"PRId64" streams valid:%"PRId64" invalid:%"PRId64, 
+            getpid(), complete_frames, incomplete_frames, valid_streams, invalid_streams);
+    }
+    for(int i = 0; i < (int)top_errors.size(); i++){
+        LReport("[summary] [%d] top error #%d: ret=%d, count=%"PRId64, getpid(), i, top_errors[i].second, top_errors[i].first);
+    }
+    
+    if(report_file.empty()){
+        return ret;
+    }
+    
+    FILE* f = fopen(report_file.c_str(), "w");
+    if(f == NULL){
+        ret = ERROR_ST_OPEN_REPORT;
+        Error("open report file %s failed. ret=%d", report_file.c_str(), ret);
+        return ret;
+    }
+    
+    fprintf(f, "{\"code\":0,\"pid\":%d,\"seed\":%u,\"duration\":%"PRId64","
+        "\"clients\":%"PRId64",\"tasks\":%"PRId64",\"succeed\":%"PRId64",\"failed\":%"PRId64","
+        "\"sub_tasks\":%"PRId64",\"err_sub_tasks\":%"PRId64",\"nread\":%"PRId64",\"nwrite\":%"PRId64","
+        "\"setup\":{\"count\":%"PRId64",\"p50\":%"PRId64",\"p95\":%"PRId64",\"p99\":%"PRId64"},"
+        "\"first_audio\":{\"count\":%"PRId64",\"p50\":%"PRId64",\"p95\":%"PRId64",\"p99\":%"PRId64"},"
+        "\"first_video\":{\"count\":%"PRId64",\"p50\":%"PRId64",\"p95\":%"PRId64",\"p99\":%"PRId64"},"
+        "\"freezes\":{\"count\":%"PRId64",\"max\":%"PRId64"},"
+        "\"sequence_changes\":{\"count\":%"PRId64",\"max_gap\":%"PRId64"},"
+        "\"segment\":{\"count\":%"PRId64",\"p50\":%"PRId64",\"p95\":%"PRId64",\"p99\":%"PRId64",\"bytes\":%"PRId64"},\"stales\":%"PRId64","
+        "\"frames\":{\"complete\":%"PRId64",\"incomplete\":%"PRId64"},"
+        "\"streams\":{\"valid\":%"PRId64",\"invalid\":%"PRId64"},"
+        "\"errors\":[", 
+        getpid(), StUtility::GetRandomSeed(), duration, started, tasks, tasks - err_tasks - alive, err_tasks, 
+        sub_tasks, err_sub_tasks, nread, nwrite, 
+        setup.GetCount(), setup.GetPercentile(0.5), setup.GetPercentile(0.95), setup.GetPercentile(0.99),
+        first_audio.GetCount(), first_audio.GetPercentile(0.5), first_audio.GetPercentile(0.95), first_audio.GetPercentile(0.99),
+        first_video.GetCount(), first_video.GetPercentile(0.5), first_video.GetPercentile(0.95), first_video.GetPercentile(0.99),
+        freezes, max_freeze,
+        sequence_changes, max_sequence_gap,
+        segment.GetCount(), segment.GetPercentile(0.5), segment.GetPercentile(0.95), segment.GetPercentile(0.99), segment_bytes, stales,
+        complete_frames, incomplete_frames, valid_streams, invalid_streams);
+    for(int i = 0; i < (int)top_errors.size(); i++){
+        fprintf(f, "%s{\"code\":%d,\"count\":%"PRId64"}", (i > 0)? ",":"", top_errors[i].second, top_errors[i].first);
+    }
+    fprintf(f, "],\"reconnects\":{\"total\":%"PRId64",\"max\":%"PRId64",\"clients\":{", total_reconnects, max_reconnects);
+    for(std::map<int, int64_t>::iterator it = reconnects.begin(); it != reconnects.end(); ++it){
+        fprintf(f, "%s\"%d\":%"PRId64, (it != reconnects.begin())? ",":"", it->first, it->second);
+    }
+    fprintf(f, "}}}\n");
+    fclose(f);
+    
+    Trace("write summary to report %s", report_file.c_str());
+    
+    return ret;
+}
+
 StStatistic* statistic = new StStatistic();
 
 StTask::StTask(){
@@ -139,13 +616,20 @@ int StTask::GetId(){
     return id;
 }
 
+// the st-thread of each task, key is the task id.
+static std::map<int, st_thread_t> _threads;
+// the pipe to notify the main thread for signal.
+static int _signal_pipes[2] = {-1, -1};
+
+bool StFarm::quit = false;
+
 StFarm::StFarm(){
 }
 
 StFarm::~StFarm(){
 }
 
-int StFarm::Initialize(double report){
+int StFarm::Initialize(double report, unsigned int seed){
     int ret = ERROR_SUCCESS;
     
     report_seconds = report;
@@ -163,7 +647,95 @@ int StFarm::Initialize(double report){
         return ret;
     }
     
-    StUtility::InitRandom();
+    StUtility::InitRandom(seed);
+    
+    // the signal handler only write to pipe, the main thread will read it.
+    if(pipe(_signal_pipes) == -1){
+        ret = ERROR_ST_INITIALIZE;
+        Error("create signal pipe failed. ret=%d", ret);
+        return ret;
+    }
+    signal(SIGINT, signal_handler);
+    signal(SIGTERM, signal_handler);
+    signal(SIGPIPE, SIG_IGN);
+    
+    return ret;
+}
+
+// each client use one tcp connection.
+#define FdsPerClient 1
+// the fds for stdio, event system and others.
+#define FdsReserved 16
+// the default stack size of st-thread, @see ST_DEFAULT_STACK_SIZE of st.
+#define StackPerClient (64 * 1024)
+
+// read the MemAvailable of /proc/meminfo in bytes, -1 if not available.
+static int64_t read_mem_available(){
+    FILE* f = fopen("/proc/meminfo", "r");
+    if(f == NULL){
+        return -1;
+    }
+    
+    int64_t available = -1;
+    char line[256];
+    while(fgets(line, sizeof(line), f) != NULL){
+        long long kbytes = 0;
+        if(sscanf(line, "MemAvailable: %lld kB", &kbytes) == 1){
+            available = (int64_t)kbytes * 1024;
+            break;
+        }
+    }
+    fclose(f);
+    
+    return available;
+}
+
+int StFarm::CheckLimits(int clients, bool force){
+    return CheckLimits(clients, 0, 0, force);
+}
+
+int StFarm::CheckLimits(int clients, int extra_fds, int64_t extra_bytes, bool force){
+    int ret = ERROR_SUCCESS;
+    
+    // the st_init already set the fd limit to the hard limit.
+    int64_t nb_fds = st_getfdlimit();
+    int64_t required_fds = (int64_t)clients * (FdsPerClient + extra_fds) + FdsReserved;
+    if(nb_fds > 0 && required_fds > nb_fds){
+        ret = ERROR_ST_RLIMIT;
+        Warn("%d clients require %"PRId64" fds, but RLIMIT_NOFILE is %"PRId64", "
+            "please raise it by: ulimit -HSn %"PRId64, clients, required_fds, nb_fds, required_fds);
+    }
+    
+    // each st-thread maps its stack, which is limited by the virtual memory.
+    rlimit rlim;
+    if(getrlimit(RLIMIT_AS, &rlim) == 0 && rlim.rlim_cur != RLIM_INFINITY){
+        int64_t required_bytes = (int64_t)clients * (StackPerClient + extra_bytes);
+        if(required_bytes > (int64_t)rlim.rlim_cur){
+            ret = ERROR_ST_RLIMIT;
+            Warn("%d clients require %"PRId64"MB virtual memory for stacks and buffers, but RLIMIT_AS is %"PRId64"MB, "
+                "please raise it by: ulimit -v unlimited", clients, required_bytes / 1024 / 1024, 
+                (int64_t)rlim.rlim_cur / 1024 / 1024);
+        }
+    }
+    
+    // the stacks and buffers are allocated from the physical memory when used.
+    int64_t available = read_mem_available();
+    int64_t required_bytes = (int64_t)clients * (StackPerClient + extra_bytes);
+    if(available > 0 && required_bytes > available){
+        ret = ERROR_ST_RLIMIT;
+        Warn("%d clients require %"PRId64"MB memory for stacks and buffers, but MemAvailable is %"PRId64"MB, "
+            "please use fewer clients", clients, required_bytes / 1024 / 1024, available / 1024 / 1024);
+    }
+    
+    if(ret != ERROR_SUCCESS && force){
+        Warn("ignore the resource limits for force, ret=%d", ret);
+        return ERROR_SUCCESS;
+    }
+    
+    if(ret != ERROR_SUCCESS){
+        Error("resource limits exceeded, use --force to ignore. ret=%d", ret);
+        return ret;
+    }
     
     return ret;
 }
@@ -171,28 +743,96 @@ int StFarm::Initialize(double report){
 int StFarm::Spawn(StTask* task){
     int ret = ERROR_SUCCESS;
     
-    if(st_thread_create(st_thread_function, task, 0, 0) == NULL){
+    st_thread_t thread = NULL;
+    if((thread = st_thread_create(st_thread_function, task, 0, 0)) == NULL){
         ret = ERROR_ST_THREAD_CREATE;
         Error("crate st_thread failed, ret=%d", ret);
         return ret;
     }
+    _threads[task->GetId()] = thread;
     
     Trace("create thread for task #%d success", task->GetId());
     
     return ret;
 }
 
-int StFarm::WaitAll(){
+int StFarm::WaitAll(double duration, double grace, string report_file){
     int ret = ERROR_SUCCESS;
     
-    // main thread turn to a report therad.
-    statistic->DoReport(report_seconds * 1000);
+    if(st_thread_create(report_cycle, this, 0, 0) == NULL){
+        ret = ERROR_ST_THREAD_CREATE;
+        Error("create report thread failed. ret=%d", ret);
+        return ret;
+    }
+    
+    // main thread wait for signal.
+    st_netfd_t stfd = NULL;
+    if((stfd = st_netfd_open(_signal_pipes[0])) == NULL){
+        ret = ERROR_OPEN_SOCKET;
+        Error("open signal pipe failed. ret=%d", ret);
+        return ret;
+    }
+    
+    st_utime_t timeout = ST_UTIME_NO_TIMEOUT;
+    if(duration > 0){
+        timeout = (st_utime_t)(duration * 1000 * 1000);
+    }
+    
+    // quit as signal when the duration elapsed.
+    int signo = 0;
+    if(st_read(stfd, &signo, sizeof(int), timeout) != sizeof(int)){
+        if(errno != ETIME){
+            ret = ERROR_READ;
+            Error("read signal failed. ret=%d", ret);
+            return ret;
+        }
+        Event("quit", "run for %.2fs, quit", duration);
+    } else{
+        Event("quit", "got signal %d, quit", signo);
+    }
+    
+    quit = true;
+    statistic->OnQuit();
+    Trace("wait for %d tasks to quit in %.2fs", (int)_threads.size(), grace);
+    
+    // interrupt the tasks until all quit, for task may ignore the interrupt of sleep.
+    int64_t deadline = StUtility::GetCurrentTime() + (int64_t)(grace * 1000);
+    while(!_threads.empty() && StUtility::GetCurrentTime() < deadline){
+        for(std::map<int, st_thread_t>::iterator it = _threads.begin(); it != _threads.end(); ++it){
+            st_thread_interrupt(it->second);
+        }
+        st_usleep(100 * 1000);
+    }
+    
+    if(!_threads.empty()){
+        Warn("%d tasks not quit in %.2fs, ignore", (int)_threads.size(), grace);
+    }
     
-    st_thread_exit(NULL);
+    if((ret = statistic->Summary(report_file)) != ERROR_SUCCESS){
+        return ret;
+    }
     
     return ret;
 }
 
+bool StFarm::IsQuit(){
+    return quit;
+}
+
+void StFarm::signal_handler(int signo){
+    // ignore the error, for the signal maybe already notified.
+    ssize_t nwrite = write(_signal_pipes[1], &signo, sizeof(int));
+    (void)nwrite;
+}
+
+void* StFarm::report_cycle(void* args){
+    StFarm* farm = (StFarm*)args;
+    
+    statistic->DoReport(farm->report_seconds * 1000);
+    
+    return NULL;
+}
+
 void* StFarm::st_thread_function(void* args){
     StTask* task = (StTask*)args;
     
@@ -203,6 +843,7 @@ void* StFarm::st_thread_function(void* args){
     int ret = task->Process();
     
     statistic->OnThreadQuit(task->GetId());
+    _threads.erase(task->GetId());
     
     if(ret != ERROR_SUCCESS){
         Warn("st task terminate with ret=%d", ret);
@@ -219,6 +860,7 @@ void* StFarm::st_thread_function(void* args){
 StSocket::StSocket(){
     sock_nfd = NULL;
     status = SocketInit;
+    recv_timeout = ST_UTIME_NO_TIMEOUT;
 }
 
 StSocket::~StSocket(){
@@ -233,6 +875,10 @@ SocketStatus StSocket::Status(){
     return status;
 }
 
+void StSocket::SetRecvTimeout(st_utime_t timeout_us){
+    recv_timeout = timeout_us;
+}
+
 int StSocket::Connect(const char* ip, int port){
     int ret = ERROR_SUCCESS;
     
@@ -289,7 +935,7 @@ int StSocket::Connect(const char* ip, int port){
 int StSocket::Read(const void* buf, size_t size, ssize_t* nread){
     int ret = ERROR_SUCCESS;
     
-    ssize_t got = st_read(sock_nfd, (void*)buf, size, ST_UTIME_NO_TIMEOUT);
+    ssize_t got = st_read(sock_nfd, (void*)buf, size, recv_timeout);
     
     // On success a non-negative integer indicating the number of bytes actually read is returned 
     // (a value of 0 means the network connection is closed or end of file is reached).
@@ -298,8 +944,13 @@ int StSocket::Read(const void* buf, size_t size, ssize_t* nread){
             errno = ECONNRESET;
         }
         
-        ret = ERROR_READ;
-        status = SocketDisconnected;
+        // the connection is ok when timeout, the caller decide to close it or not.
+        if(got < 0 && errno == ETIME){
+            ret = ERROR_SOCKET_TIMEOUT;
+        }else{
+            ret = ERROR_READ;
+            status = SocketDisconnected;
+        }
     }
     
     if(got > 0){
@@ -316,7 +967,7 @@ int StSocket::Read(const void* buf, size_t size, ssize_t* nread){
 int StSocket::Readv(const iovec *iov, int iov_size, ssize_t* nread){
     int ret = ERROR_SUCCESS;
     
-    ssize_t got = st_readv(sock_nfd, iov, iov_size, ST_UTIME_NO_TIMEOUT);
+    ssize_t got = st_readv(sock_nfd, iov, iov_size, recv_timeout);
     
     // On success a non-negative integer indicating the number of bytes actually read is returned 
     // (a value of 0 means the network connection is closed or end of file is reached).
@@ -325,8 +976,13 @@ int StSocket::Readv(const iovec *iov, int iov_size, ssize_t* nread){
             errno = ECONNRESET;
         }
         
-        ret = ERROR_READ;
-        status = SocketDisconnected;
+        // the connection is ok when timeout, the caller decide to close it or not.
+        if(got < 0 && errno == ETIME){
+            ret = ERROR_SOCKET_TIMEOUT;
+        }else{
+            ret = ERROR_READ;
+            status = SocketDisconnected;
+        }
     }
     
     if(got > 0){
@@ -343,7 +999,7 @@ int StSocket::Readv(const iovec *iov, int iov_size, ssize_t* nread){
 int StSocket::ReadFully(const void* buf, size_t size, ssize_t* nread){
     int ret = ERROR_SUCCESS;
     
-    ssize_t got = st_read_fully(sock_nfd, (void*)buf, size, ST_UTIME_NO_TIMEOUT);
+    ssize_t got = st_read_fully(sock_nfd, (void*)buf, size, recv_timeout);
     
     // On success a non-negative integer indicating the number of bytes actually read is returned 
     // (a value less than nbyte means the network connection is closed or end of file is reached)
@@ -352,8 +1008,13 @@ int StSocket::ReadFully(const void* buf, size_t size, ssize_t* nread){
             errno = ECONNRESET;
         }
         
-        ret = ERROR_READ;
-        status = SocketDisconnected;
+        // the connection is ok when timeout, the caller decide to close it or not.
+        if(got < 0 && errno == ETIME){
+            ret = ERROR_SOCKET_TIMEOUT;
+        }else{
+            ret = ERROR_READ;
+            status = SocketDisconnected;
+        }
     }
     
     if(got > 0){
@@ -442,18 +1103,43 @@ int64_t StUtility::GetCurrentTime(){
     return ((int64_t)now.tv_sec)*1000 + ((int64_t)now.tv_usec) / 1000;
 }
 
-void StUtility::InitRandom(){
+static unsigned int _random_seed = 0;
+
+void StUtility::InitRandom(unsigned int seed){
     timeval now;
     
-    if(gettimeofday(&now, NULL) == -1){
-        srand(0);
-        return;
+    if(seed == 0 && gettimeofday(&now, NULL) == 0){
+        seed = (unsigned int)(now.tv_sec * 1000000 + now.tv_usec);
+    }
+    
+    _random_seed = seed;
+    srand(seed);
+    
+    Trace("random seed is %u, use --seed %u to reproduce it", seed, seed);
+}
+
+unsigned int StUtility::GetRandomSeed(){
+    return _random_seed;
+}
+
+unsigned int StUtility::BuildRandomSeed(int id, const char* component){
+    // FNV-1a hash of master seed, task id and component name.
+    unsigned int hash = 2166136261U;
+    
+    for(int i = 0; i < 4; i++){
+        hash = (hash ^ ((_random_seed >> (i * 8)) & 0xff)) * 16777619U;
+    }
+    for(int i = 0; i < 4; i++){
+        hash = (hash ^ ((id >> (i * 8)) & 0xff)) * 16777619U;
+    }
+    for(const char* p = component; *p; p++){
+        hash = (hash ^ (unsigned char)*p) * 16777619U;
     }
     
-    srand(now.tv_sec * 1000000 + now.tv_usec);
+    return hash;
 }
 
-st_utime_t StUtility::BuildRandomMTime(double sleep_seconds){
+st_utime_t StUtility::BuildRandomMTime(double sleep_seconds, unsigned int* seed){
     if(sleep_seconds <= 0){
         return 0 * 1000;
     }
@@ -461,7 +1147,7 @@ st_utime_t StUtility::BuildRandomMTime(double sleep_seconds){
     // 80% consts value.
     // 40% random value.
     // to get more graceful random time to mocking HLS client.
-    st_utime_t sleep_ms = (int)(sleep_seconds * 1000 * 0.7) + rand() % (int)(sleep_seconds * 1000 * 0.4);
+    st_utime_t sleep_ms = (int)(sleep_seconds * 1000 * 0.7) + rand_r(seed) % (int)(sleep_seconds * 1000 * 0.4);
     
     return sleep_ms;
 }
@@ -511,3 +1197,8 @@ int StLogContext::GetId(){
     return cache[st_thread_self()];
 }
 
+string StLogContext::GetStream(){
+    StClientStatistic* client = statistic->GetClient(GetId());
+    return client? client->url : "";
+}
+
@@ -30,11 +30,80 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 #include <map>
 #include <string>
+#include <vector>
 
 #include <st.h>
 
 #include <htl_core_log.hpp>
 
+// the statistic of a client, that is a st-thread(task).
+struct StClientStatistic
+{
+    int tid;
+    // the url of current task, ie. the m3u8 url.
+    std::string url;
+    bool alive;
+    int64_t nread, nwrite;
+    int64_t tasks, err_tasks, sub_tasks, err_sub_tasks;
+    // the first audio/video packet in ms since connect of current task, -1 if not got.
+    int64_t first_audio, first_video;
+    // the times to reconnect when error.
+    int64_t reconnects;
+    // the received video bitrate and fps of last second, -1 if no video.
+    int video_kbps, video_fps;
+    // the times video freezed, and the max freeze duration in ms.
+    int64_t freezes, max_freeze;
+    // the times h.264 sps/pps changed.
+    int64_t sequence_changes;
+    
+    StClientStatistic();
+};
+
+// the fixed buckets histogram, no allocation when update.
+#define StHistogramBuckets 10
+class StHistogram
+{
+private:
+    int64_t count, sum;
+    int64_t buckets[StHistogramBuckets];
+public:
+    StHistogram();
+    virtual ~StHistogram();
+public:
+    virtual void Update(int64_t value);
+public:
+    virtual int64_t GetCount();
+    virtual int64_t GetSum();
+    // get the cumulative count of values <= the upper bound of bucket.
+    virtual int64_t GetBucket(int index);
+    // get the upper bound of bucket, in the unit of value.
+    static int64_t GetBound(int index);
+};
+
+// the samples to calc the percentiles, one sample for each connection.
+// keep at most StSamplesMax samples by reservoir sampling, so the memory and the cost
+// to sort is bounded for churn mode or long duration.
+#define StSamplesMax 4096
+class StSamples
+{
+private:
+    // the number of all updated values, maybe more than the kept samples.
+    int64_t count;
+    std::vector<int64_t> values;
+    // whether values are sorted, to sort once for each snapshot.
+    bool sorted;
+    unsigned int seed;
+public:
+    StSamples();
+    virtual ~StSamples();
+public:
+    virtual void Update(int64_t value);
+public:
+    virtual int64_t GetCount();
+    // get the percentile of samples, ie. 0.95 for p95, -1 if no sample.
+    virtual int64_t GetPercentile(double p);
+};
+
 // the statistic for each st-thread(task)
 class StStatistic
 {
@@ -43,6 +112,34 @@ private:
     int64_t starttime, task_duration;
     int64_t nread, nwrite;
     int64_t tasks, err_tasks, sub_tasks, err_sub_tasks;
+    // the statistic of each client, key is the tid.
+    std::map<int, StClientStatistic> clients;
+    // the time in ms from connect to the first packet of players.
+    StHistogram first_packet;
+    // the time in ms from connect to the first audio/video packet of players.
+    StSamples first_audio, first_video;
+    // the time in ms from connect to play success, for each connection.
+    StSamples setup;
+    // the number of clients started, and the count of each error code.
+    int64_t started;
+    std::map<int, int64_t> errors;
+    // the reconnects of each client, key is tid, kept after client quit for summary.
+    std::map<int, int64_t> reconnects;
+    // the times video freezed of players, and the max freeze duration in ms.
+    int64_t freezes, max_freeze;
+    // the times h.264 sps/pps changed of players, and the max gap of video in ms around the change.
+    int64_t sequence_changes, max_sequence_gap;
+    // the time in ms to download each segment of HLS, and the bytes of all segments.
+    StSamples segment;
+    int64_t segment_bytes;
+    // the times the live playlist of HLS is stale.
+    int64_t stales;
+    // the validated h.264 frames of players, whether all NALUs are complete.
+    int64_t complete_frames, incomplete_frames;
+    // the validated h.264 streams of players, whether decodable when play done.
+    int64_t valid_streams, invalid_streams;
+    // when quit, the tasks interrupted are not errors.
+    bool quiting;
 public:
     StStatistic();
     virtual ~StStatistic();
@@ -57,17 +154,92 @@ public:
     // when task start request url, ie. get m3u8
     virtual void OnTaskStart(int tid, std::string task_url);
     // when task error.
-    virtual void OnTaskError(int tid, int duration_seconds);
+    virtual void OnTaskError(int tid, int duration_seconds, int error_code);
     // when task finish request url, ie. finish all ts in m3u8
     virtual void OnTaskEnd(int tid, int duration_seconds);
     // when sub task start, ie. get ts in m3u8
     virtual void OnSubTaskStart(int tid, std::string sub_task_url);
     // when sub task error.
-    virtual void OnSubTaskError(int tid, int duration_seconds);
+    virtual void OnSubTaskError(int tid, int duration_seconds, int error_code);
     // when sub task finish, ie. finish a ts.
     virtual void OnSubTaskEnd(int tid, int duration_seconds);
+    // when player got the first packet, the duration in ms since connect.
+    virtual void OnFirstPacket(int tid, int64_t duration_ms);
+    virtual void OnFirstAudio(int tid, int64_t duration_ms);
+    virtual void OnFirstVideo(int tid, int64_t duration_ms);
+    // when player connected and play success, the duration in ms since connect.
+    virtual void OnSetup(int tid, int64_t duration_ms);
+    // when task error and will reconnect.
+    virtual void OnReconnect(int tid);
+    // when player got the video of a second, the received bitrate in kbps and frames.
+    virtual void OnVideoQuality(int tid, int kbps, int fps);
+    // when player got no new video for a while, the duration in ms.
+    virtual void OnFreeze(int tid, int64_t duration_ms);
+    // when the counted freeze is ongoing or ends, update the duration in ms.
+    virtual void OnFreezing(int tid, int64_t duration_ms);
+    // when player got a different h.264 sequence header, the gap in ms since last video.
+    virtual void OnSequenceChange(int tid, int64_t gap_ms);
+    // when HLS segment downloaded, the duration in ms to fetch it and the size in bytes.
+    virtual void OnSegment(int tid, int64_t duration_ms, int64_t bytes);
+    // when HLS live playlist got no new segment for 2 target duration.
+    virtual void OnStale(int tid);
+    // when validated a h.264 frame, whether all NALUs are complete.
+    virtual void OnVideoFrame(int tid, bool complete);
+    // when play done and validated the h.264 stream, whether it's decodable.
+    virtual void OnVideoValidate(int tid, bool valid);
+    // when the load test is quiting, ie. interrupted by signal.
+    virtual void OnQuit();
+public:
+    virtual int GetThreads();
+    virtual int GetAlive();
+    // the duration in ms since start.
+    virtual int64_t GetDuration();
+    // the sum of task duration in ms.
+    virtual int64_t GetTaskDuration();
+    virtual int64_t GetReadBytes();
+    virtual int64_t GetWriteBytes();
+    virtual int64_t GetTasks();
+    virtual int64_t GetErrorTasks();
+    virtual int64_t GetSubTasks();
+    virtual int64_t GetErrorSubTasks();
+    virtual StHistogram* GetFirstPacket();
+    virtual StSamples* GetFirstAudio();
+    virtual StSamples* GetFirstVideo();
+    virtual StSamples* GetSetup();
+    virtual int64_t GetFreezes();
+    virtual int64_t GetMaxFreeze();
+    virtual int64_t GetSequenceChanges();
+    virtual int64_t GetMaxSequenceGap();
+    virtual StSamples* GetSegment();
+    virtual int64_t GetSegmentBytes();
+    virtual int64_t GetStales();
+    /**
+    * get the average video quality of alive clients which got or sent video in last second.
+    * @param pclients output the number of clients with video.
+    */
+    virtual void GetVideoQuality(int* pclients, int64_t* pkbps, int64_t* pfps);
+    virtual int64_t GetCompleteFrames();
+    virtual int64_t GetIncompleteFrames();
+    virtual int64_t GetValidStreams();
+    virtual int64_t GetInvalidStreams();
+public:
+    /**
+    * get the statistic of client by tid, NULL if not found.
+    */
+    virtual StClientStatistic* GetClient(int tid);
+    /**
+    * get the statistic of all clients.
+    */
+    virtual std::map<int, StClientStatistic>& GetClients();
 public:
     virtual void DoReport(double sleep_ms);
+    /**
+    * print the summary of the run, and write to the report file in json.
+    * @param report_file the json file to write, ignore when empty.
+    */
+    virtual int Summary(std::string report_file);
+private:
+    virtual StClientStatistic& Client(int tid);
 };
 
 extern StStatistic* statistic;
@@ -95,14 +267,42 @@ class StFarm
 {
 private:
     double report_seconds;
+    static bool quit;
 public:
     StFarm();
     virtual ~StFarm();
 public:
-    virtual int Initialize(double report);
+    /**
+    * initialize the st and random.
+    * @param seed the master random seed, 0 to generate one by time.
+    */
+    virtual int Initialize(double report, unsigned int seed);
+    /**
+    * check whether the local resource limits can hold the clients,
+    * for instance, the fd limit, virtual memory and available memory for st-thread stacks.
+    * @param force when true, only warn when limits will be exceeded.
+    */
+    virtual int CheckLimits(int clients, bool force);
+    /**
+    * check the limits, where each client use extra resources except the socket and stack,
+    * for instance, the publisher opens the flv file and reads the tag to memory.
+    * @param extra_fds the fds used by each client except the socket.
+    * @param extra_bytes the memory used by each client except the stack.
+    */
+    virtual int CheckLimits(int clients, int extra_fds, int64_t extra_bytes, bool force);
     virtual int Spawn(StTask* task);
-    virtual int WaitAll();
+    /**
+    * report until SIGINT or SIGTERM, then interrupt all tasks and wait for them to quit.
+    * @param duration the seconds to run then quit as signal, 0 to run until signal.
+    * @param grace the max seconds to wait for tasks to quit.
+    * @param report_file the json file to write the summary, ignore when empty.
+    */
+    virtual int WaitAll(double duration, double grace, std::string report_file);
+    // whether the farm is quiting, the task should not start new loop.
+    static bool IsQuit();
 private:
+    static void signal_handler(int signo);
+    static void* report_cycle(void* args);
     static void* st_thread_function(void* args);
 };
 
@@ -119,12 +319,18 @@ class StSocket
 private:
     SocketStatus status;
     st_netfd_t sock_nfd;
+    // the timeout in us to read, ST_UTIME_NO_TIMEOUT to wait forever.
+    st_utime_t recv_timeout;
 public:
     StSocket();
     virtual ~StSocket();
 public:
     virtual st_netfd_t GetStfd();
     virtual SocketStatus Status();
+    /**
+    * set the read timeout, the read return ERROR_SOCKET_TIMEOUT when no data in timeout.
+    */
+    virtual void SetRecvTimeout(st_utime_t timeout_us);
     virtual int Connect(const char* ip, int port);
     virtual int Read(const void* buf, size_t size, ssize_t* nread);
     virtual int Readv(const iovec *iov, int iov_size, ssize_t* nread);
@@ -139,8 +345,17 @@ class StUtility
 {
 public:
     static int64_t GetCurrentTime();
-    static void InitRandom();
-    static st_utime_t BuildRandomMTime(double sleep_seconds);
+    /**
+    * initialize the master random seed, 0 to generate one by time.
+    */
+    static void InitRandom(unsigned int seed);
+    static unsigned int GetRandomSeed();
+    /**
+    * derive the random seed for the component of task, 
+    * so each component of each task has its own reproducible random sequence.
+    */
+    static unsigned int BuildRandomSeed(int id, const char* component);
+    static st_utime_t BuildRandomMTime(double sleep_seconds, unsigned int* seed);
     static int DnsResolve(std::string host, std::string& ip);
 };
 
@@ -155,6 +370,7 @@ public:
 public:
     virtual void SetId(int id);
     virtual int GetId();
+    virtual std::string GetStream();
 };
 
 #endif